@@ -0,0 +1,134 @@
+package kvstore
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/shipdock/libkv/store"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_BOLTDB_BUCKET = "shipdock"
+
+// boltdbStore adapts the libkv boltdb backend to the directory semantics
+// the proxies expect from consul/etcd. BoltDB has no directories, only a
+// flat bucket of keys, so List and DeleteTree are prefix scans and an empty
+// "directory" simply does not exist.
+type boltdbStore struct {
+	store.Store
+	path string
+}
+
+// boltdbOptions reads boltdb:///path/to/kv.db?bucket=...&root=...&persist=...
+// The URL path is the database file, so the KV root path comes from the
+// "root" query parameter instead.
+func boltdbOptions(uri *url.URL, opts *Options) error {
+	if len(uri.Path) == 0 {
+		return fmt.Errorf("boltdb: database file path is missing (url:%s)", uri)
+	}
+	query := uri.Query()
+	opts.Endpoints = []string{uri.Path}
+	opts.RootPath = query.Get("root")
+	opts.Bucket = query.Get("bucket")
+	if len(opts.Bucket) == 0 {
+		opts.Bucket = DEFAULT_BOLTDB_BUCKET
+	}
+	// without persist, the database file is opened and flock'ed per
+	// operation so several agents on the same host can share it.
+	// with persist, this process holds the lock until Close.
+	if v := query.Get("persist"); len(v) > 0 {
+		persist, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("boltdb: invalid persist value: %s", v)
+		}
+		opts.PersistConnection = persist
+	}
+	return nil
+}
+
+func newBoltdbStore(s store.Store, path string) store.Store {
+	return &boltdbStore{Store: s, path: path}
+}
+
+func (b *boltdbStore) wrapError(err error) error {
+	if err == bolt.ErrTimeout {
+		return fmt.Errorf("boltdb: %s is locked by another writer: %v", b.path, err)
+	}
+	return err
+}
+
+// consul and etcd ignore a leading slash, boltdb stores keys verbatim
+func boltdbKey(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+func boltdbPrefix(directory string) string {
+	directory = strings.TrimSuffix(boltdbKey(directory), "/")
+	if len(directory) == 0 {
+		return ""
+	}
+	return directory + "/"
+}
+
+func (b *boltdbStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	return b.wrapError(b.Store.Put(boltdbKey(key), value, options))
+}
+
+func (b *boltdbStore) Get(key string) (*store.KVPair, error) {
+	kv, err := b.Store.Get(boltdbKey(key))
+	return kv, b.wrapError(err)
+}
+
+func (b *boltdbStore) Delete(key string) error {
+	return b.wrapError(b.Store.Delete(boltdbKey(key)))
+}
+
+func (b *boltdbStore) Exists(key string) (bool, error) {
+	ok, err := b.Store.Exists(boltdbKey(key))
+	return ok, b.wrapError(err)
+}
+
+func (b *boltdbStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	prefix := boltdbPrefix(directory)
+	kvs, err := b.Store.List(prefix, true)
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+	if recursive {
+		return kvs, nil
+	}
+	results := make([]*store.KVPair, 0, len(kvs))
+	for _, kv := range kvs {
+		if strings.Contains(strings.TrimPrefix(kv.Key, prefix), "/") {
+			continue
+		}
+		results = append(results, kv)
+	}
+	if len(results) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return results, nil
+}
+
+func (b *boltdbStore) DeleteTree(directory string) error {
+	// KVStore.Remove deletes leaf keys through DeleteTree as well,
+	// so remove the key itself along with everything below it.
+	if err := b.Store.Delete(boltdbKey(directory)); err != nil && err != store.ErrKeyNotFound {
+		return b.wrapError(err)
+	}
+	if err := b.Store.DeleteTree(boltdbPrefix(directory)); err != nil && err != store.ErrKeyNotFound {
+		return b.wrapError(err)
+	}
+	return nil
+}
+
+func (b *boltdbStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	ok, kv, err := b.Store.AtomicPut(boltdbKey(key), value, previous, options)
+	return ok, kv, b.wrapError(err)
+}
+
+func (b *boltdbStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	ok, err := b.Store.AtomicDelete(boltdbKey(key), previous)
+	return ok, b.wrapError(err)
+}
@@ -0,0 +1,40 @@
+package kvstore
+
+import (
+	"github.com/shipdock/libkv/store"
+	"reflect"
+	"testing"
+)
+
+func TestBoltdbOptions(t *testing.T) {
+	for _, tc := range []struct {
+		url       string
+		endpoints []string
+		root      string
+		bucket    string
+		persist   bool
+		fails     bool
+	}{
+		{url: "boltdb:///var/lib/kv.db", endpoints: []string{"/var/lib/kv.db"}, bucket: DEFAULT_BOLTDB_BUCKET},
+		{url: "boltdb:///var/lib/kv.db?root=shipdock&bucket=b", endpoints: []string{"/var/lib/kv.db"}, root: "shipdock", bucket: "b"},
+		{url: "boltdb:///var/lib/kv.db?persist=true", endpoints: []string{"/var/lib/kv.db"}, bucket: DEFAULT_BOLTDB_BUCKET, persist: true},
+		{url: "boltdb:///var/lib/kv.db?persist=0", endpoints: []string{"/var/lib/kv.db"}, bucket: DEFAULT_BOLTDB_BUCKET},
+		{url: "boltdb:///var/lib/kv.db?persist=maybe", fails: true},
+		{url: "boltdb://", fails: true},
+	} {
+		opts, err := ParseOptions(tc.url)
+		if tc.fails {
+			if err == nil {
+				t.Fatal(tc.url, opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(tc.url, err)
+		}
+		if opts.Backend != store.BOLTDB || !reflect.DeepEqual(opts.Endpoints, tc.endpoints) || opts.RootPath != tc.root ||
+			opts.Bucket != tc.bucket || opts.PersistConnection != tc.persist {
+			t.Fatal(tc.url, opts)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_CACHE_MAX_STALENESS = 30 * time.Second
+
+// Consistency selects where the reads of a proxy with a cache go.
+type Consistency int
+
+const (
+	// Linearizable reads always go to the backend
+	Linearizable Consistency = iota
+	// Cached reads are served from the proxy cache while it is at most
+	// its max staleness old
+	Cached
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case Linearizable:
+		return "linearizable"
+	case Cached:
+		return "cached"
+	}
+	return fmt.Sprintf("Consistency(%d)", int(c))
+}
+
+// CacheStats counts the reads served by a proxy cache (Hits) and the
+// ones which had to list the backend first (Misses). Updates are the
+// trees received from the backend watch.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Updates uint64
+	Keys    int
+	// Age is the time since the cache was last known to be current
+	Age time.Duration
+}
+
+// proxyCache keeps the raw pairs below a proxy root. Values are decoded
+// on every read so callers never share them. The pairs map is replaced
+// on every update and never modified.
+type proxyCache struct {
+	mu           sync.Mutex
+	maxStaleness time.Duration
+	consistency  Consistency
+	kvs          map[string]*store.KVPair
+	refreshed    time.Time
+	valid        bool
+	// generation is bumped by every invalidation, fills of listings
+	// started before are dropped
+	generation uint64
+	stats      CacheStats
+	stopCh     chan struct{}
+}
+
+// EnableCache keeps the values below the proxy root in memory, filled
+// by a List and kept fresh by WatchTree, and serves Get and List from
+// it. A cache older than maxStaleness (no watch update or list within
+// that time, e.g. during a disconnect) is listed again before it is
+// read, and writes through this proxy make the next read list again.
+// Plan and Sync always read the backend. The cache starts in Cached
+// consistency and runs until DisableCache or KVStore.Close.
+func (c *Proxy[T]) EnableCache(maxStaleness time.Duration) {
+	if maxStaleness <= 0 {
+		maxStaleness = DEFAULT_CACHE_MAX_STALENESS
+	}
+	cache := &proxyCache{
+		maxStaleness: maxStaleness,
+		consistency:  Cached,
+		stopCh:       make(chan struct{}),
+	}
+	c.mu.Lock()
+	old := c.cache
+	c.cache = cache
+	c.mu.Unlock()
+	if old != nil {
+		close(old.stopCh)
+	}
+	go c.watchCache(cache)
+}
+
+func (c *Proxy[T]) DisableCache() {
+	c.mu.Lock()
+	cache := c.cache
+	c.cache = nil
+	c.mu.Unlock()
+	if cache != nil {
+		close(cache.stopCh)
+	}
+}
+
+// SetConsistency switches the reads of the cache between Cached and
+// Linearizable, the cache is kept fresh either way.
+func (c *Proxy[T]) SetConsistency(consistency Consistency) {
+	if cache := c.currentCache(); cache != nil {
+		cache.mu.Lock()
+		cache.consistency = consistency
+		cache.mu.Unlock()
+	}
+}
+
+func (c *Proxy[T]) CacheStats() CacheStats {
+	cache := c.currentCache()
+	if cache == nil {
+		return CacheStats{}
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	stats := cache.stats
+	stats.Keys = len(cache.kvs)
+	if cache.valid {
+		stats.Age = time.Since(cache.refreshed)
+	}
+	return stats
+}
+
+func (c *Proxy[T]) currentCache() *proxyCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache
+}
+
+// cached returns the cached pairs by key relative to the proxy root,
+// listing the backend first when the cache is stale. It returns false
+// when reads have to go to the backend.
+func (c *Proxy[T]) cached(ctx context.Context) (map[string]*store.KVPair, bool) {
+	cache := c.currentCache()
+	if cache == nil {
+		return nil, false
+	}
+	cache.mu.Lock()
+	if cache.consistency != Cached {
+		cache.mu.Unlock()
+		return nil, false
+	}
+	if cache.valid && time.Since(cache.refreshed) <= cache.maxStaleness {
+		cache.stats.Hits++
+		kvs := cache.kvs
+		cache.mu.Unlock()
+		return kvs, true
+	}
+	cache.stats.Misses++
+	generation := cache.generation
+	cache.mu.Unlock()
+	var kvs []*store.KVPair
+	err := c.do(ctx, func() (err error) {
+		kvs, err = withContext(ctx, c.kvstore).List(c.rootPath, true)
+		return err
+	})
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, false
+	}
+	return c.fillCache(cache, kvs, generation), true
+}
+
+// fillCache replaces the cached pairs by kvs, listed at generation. A
+// listing which may predate an invalidation is returned to its reader
+// but not kept.
+func (c *Proxy[T]) fillCache(cache *proxyCache, kvs []*store.KVPair, generation uint64) map[string]*store.KVPair {
+	m := make(map[string]*store.KVPair, len(kvs))
+	for _, kv := range kvs {
+		if len(kv.Value) > 0 {
+			m[c.relative(kv.Key)] = kv
+		}
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if generation != cache.generation {
+		return m
+	}
+	cache.kvs = m
+	cache.refreshed = time.Now()
+	cache.valid = true
+	return m
+}
+
+// invalidateCache makes the next cached read list the backend.
+func (c *Proxy[T]) invalidateCache() {
+	if cache := c.currentCache(); cache != nil {
+		cache.invalidate()
+	}
+}
+
+func (cache *proxyCache) currentGeneration() uint64 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.generation
+}
+
+func (cache *proxyCache) invalidate() {
+	cache.mu.Lock()
+	cache.valid = false
+	cache.generation++
+	cache.mu.Unlock()
+}
+
+// watchCache runs until the cache is disabled or the KVStore closed,
+// whichever comes first ends the backend watch as well.
+func (c *Proxy[T]) watchCache(cache *proxyCache) {
+	stopCh := make(chan struct{})
+	go func() {
+		select {
+		case <-cache.stopCh:
+		case <-c.parent.stopCh:
+		}
+		close(stopCh)
+	}()
+	retry := WATCH_RETRY_MIN
+	for {
+		watchCh, err := c.kvstore.WatchTree(c.rootPath, stopCh)
+		if err == nil {
+			retry = WATCH_RETRY_MIN
+			// an update is dropped when a write invalidated the cache
+			// since the previous one, it may have been sent before the
+			// write and the update after it is on its way
+			generation := cache.currentGeneration()
+			for kvs := range watchCh {
+				c.fillCache(cache, kvs, generation)
+				cache.mu.Lock()
+				cache.stats.Updates++
+				generation = cache.generation
+				cache.mu.Unlock()
+			}
+		}
+		// updates may be missed until the watch is back
+		cache.invalidate()
+		if err != nil {
+			c.logger.Warnf("cache watch %s: %v, retrying in %s", c.rootPath, err, retry)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > WATCH_RETRY_MAX {
+			retry = WATCH_RETRY_MAX
+		}
+	}
+}
+
+// cachedList returns the cached pairs of List(recursive), false when
+// the read has to go to the backend.
+func (c *Proxy[T]) cachedList(ctx context.Context, recursive bool) ([]*store.KVPair, bool) {
+	m, ok := c.cached(ctx)
+	if !ok {
+		return nil, false
+	}
+	kvs := make([]*store.KVPair, 0, len(m))
+	for key, kv := range m {
+		if !recursive && strings.Contains(key, "/") {
+			continue
+		}
+		kvs = append(kvs, kv)
+	}
+	return kvs, true
+}
+
+func cacheCollection[T any](k *KVStore, p *Proxy[T]) {
+	if k.opts != nil && k.opts.CacheMaxStaleness > 0 {
+		p.EnableCache(k.opts.CacheMaxStaleness)
+	}
+}
+
+// SetConsistency switches the reads of all collections with a cache.
+func (k *KVStore) SetConsistency(consistency Consistency) {
+	if k.Services != nil {
+		k.Services.proxy.SetConsistency(consistency)
+	}
+	if k.Networks != nil {
+		k.Networks.proxy.SetConsistency(consistency)
+	}
+	if k.Volumes != nil {
+		k.Volumes.proxy.SetConsistency(consistency)
+	}
+	if k.Containers != nil {
+		k.Containers.proxy.SetConsistency(consistency)
+	}
+	if k.Nodes != nil {
+		k.Nodes.proxy.SetConsistency(consistency)
+	}
+}
+
+// CacheStats returns the cache metrics of the collections by name.
+func (k *KVStore) CacheStats() map[string]CacheStats {
+	stats := make(map[string]CacheStats)
+	if k.Services != nil {
+		stats["services"] = k.Services.proxy.CacheStats()
+	}
+	if k.Networks != nil {
+		stats["networks"] = k.Networks.proxy.CacheStats()
+	}
+	if k.Volumes != nil {
+		stats["volumes"] = k.Volumes.proxy.CacheStats()
+	}
+	if k.Containers != nil {
+		stats["containers"] = k.Containers.proxy.CacheStats()
+	}
+	if k.Nodes != nil {
+		stats["nodes"] = k.Nodes.proxy.CacheStats()
+	}
+	return stats
+}
@@ -0,0 +1,144 @@
+package kvstore
+
+import (
+	"github.com/shipdock/libkv/store"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cacheStore fails the first listFailures lists and keeps the stop
+// channels of the tree watches.
+type cacheStore struct {
+	store.Store
+	mu           sync.Mutex
+	listFailures int
+	stops        []<-chan struct{}
+}
+
+func (s *cacheStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	s.mu.Lock()
+	if s.listFailures > 0 {
+		s.listFailures--
+		s.mu.Unlock()
+		return nil, store.ErrNotReachable
+	}
+	s.mu.Unlock()
+	return s.Store.List(directory, recursive)
+}
+
+func (s *cacheStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	s.mu.Lock()
+	s.stops = append(s.stops, stopCh)
+	s.mu.Unlock()
+	return s.Store.WatchTree(directory, stopCh)
+}
+
+func (s *cacheStore) stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stopCh := range s.stops {
+		select {
+		case <-stopCh:
+		default:
+			return false
+		}
+	}
+	return len(s.stops) > 0
+}
+
+func TestProxyCache(t *testing.T) {
+	k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{"cachetest"}, RootPath: "root", NodeName: "h1", CacheMaxStaleness: time.Minute, Collections: CollectionNetworks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p := k.Networks.proxy
+	if err := p.Put("n1", &Network{Name: "n1"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := p.Get("n1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := k.CacheStats()["networks"]; st.Hits < 1 || st.Keys != 1 {
+		t.Fatal(st)
+	}
+	// external write seen through watch
+	if err := k.Store.Put("root/networks/n2", []byte(`{"Name":"n2"}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the watch to update the cache", func() bool {
+		l, err := p.List(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(l) == 2
+	})
+	if err := p.Delete("n1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get("n1"); err != store.ErrKeyNotFound {
+		t.Fatal("stale after delete", err)
+	}
+	k.SetConsistency(Linearizable)
+	hits := k.CacheStats()["networks"].Hits
+	if _, err := p.Get("n2"); err != nil {
+		t.Fatal(err)
+	}
+	if k.CacheStats()["networks"].Hits != hits {
+		t.Fatal("linearizable read hit cache")
+	}
+}
+
+func TestCacheRetriesAndStops(t *testing.T) {
+	k, err := NewKVStore("mem:///r", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &cacheStore{Store: k.supervised.current(), listFailures: 2}
+	k.supervised.swap(s)
+	p, err := NewCollectionProxy[Volume](k, nil, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetRetryPolicy(&RetryPolicy{InitialInterval: time.Millisecond, MaxAttempts: 3})
+	p.EnableCache(time.Minute)
+	if err := s.Store.Put("r/x/a", []byte(`{"Name":"a"}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.CacheStats(); st.Keys != 1 {
+		t.Fatal("the failed lists were not retried", st)
+	}
+	// closing the KVStore ends the cache watch without DisableCache
+	k.Close()
+	eventually(t, "the cache watch to stop", s.stopped)
+}
+
+func TestCacheGeneration(t *testing.T) {
+	k, err := NewKVStore("mem:///r", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p, err := NewCollectionProxy[Volume](k, nil, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := &proxyCache{maxStaleness: time.Minute, consistency: Cached}
+	p.cache = cache
+	generation := cache.currentGeneration()
+	p.invalidateCache()
+	p.fillCache(cache, nil, generation)
+	if cache.valid {
+		t.Fatal("a fill started before the invalidation was kept")
+	}
+	p.fillCache(cache, nil, cache.currentGeneration())
+	if !cache.valid {
+		t.Fatal("a current fill was dropped")
+	}
+}
@@ -0,0 +1,174 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"github.com/shipdock/libkv/store"
+	"path"
+	"strings"
+)
+
+const MAX_UPDATE_RETRY_COUNT = 10
+
+// remember records the backend index a value was read at, so a later
+// PutIfUnchanged/DeleteIfUnchanged only succeeds if nobody wrote since.
+func (c *Proxy[T]) remember(key string, index uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.indexes[key] = index
+}
+
+func (c *Proxy[T]) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.indexes, key)
+}
+
+// prune forgets the keys which a listing of the proxy root did not
+// return, a listing which is not recursive only covers the keys outside
+// of subdirectories.
+func (c *Proxy[T]) prune(listed map[string]bool, recursive bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.indexes {
+		if !listed[key] && (recursive || !strings.Contains(key, "/")) {
+			delete(c.indexes, key)
+		}
+	}
+}
+
+func (c *Proxy[T]) previous(key string) *store.KVPair {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	index, ok := c.indexes[key]
+	if !ok {
+		return nil
+	}
+	return &store.KVPair{Key: path.Join(c.rootPath, key), LastIndex: index}
+}
+
+// PutIfUnchanged writes value only if key is still at the index it was
+// last read at through this proxy, or still absent if it was never read.
+// It fails with store.ErrKeyModified (or store.ErrKeyExists) otherwise.
+func (c *Proxy[T]) PutIfUnchanged(key string, value *T) error {
+	return c.PutIfUnchangedContext(context.Background(), key, value)
+}
+
+func (c *Proxy[T]) PutIfUnchangedContext(ctx context.Context, key string, value *T) error {
+	return c.atomicPut(ctx, key, value, c.previous(key), c.currentLease())
+}
+
+// atomicPut writes value tied to lease, which may be nil.
+func (c *Proxy[T]) atomicPut(ctx context.Context, key string, value *T, previous *store.KVPair, lease *Lease) error {
+	if lease != nil {
+		// stores tie keys to leases in their transactions
+		return c.do(ctx, func() error {
+			txn := newTxn(c.kvstore, c.codec, c.logger)
+			if err := c.txnPut(txn, key, value, true, previous, lease); err != nil {
+				return err
+			}
+			return txn.CommitContext(ctx)
+		})
+	}
+	bv, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	target := path.Join(c.rootPath, key)
+	c.logger.Debugf("CAS PUT:%s", target)
+	defer c.invalidateCache()
+	var kv *store.KVPair
+	err = c.do(ctx, func() (err error) {
+		_, kv, err = withContext(ctx, c.kvstore).AtomicPut(target, bv, previous, &store.WriteOptions{IsDir: false})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.remember(key, kv.LastIndex)
+	return nil
+}
+
+// DeleteIfUnchanged deletes key only if it is still at the index it was
+// last read at through this proxy.
+func (c *Proxy[T]) DeleteIfUnchanged(key string) error {
+	return c.DeleteIfUnchangedContext(context.Background(), key)
+}
+
+func (c *Proxy[T]) DeleteIfUnchangedContext(ctx context.Context, key string) error {
+	previous := c.previous(key)
+	if previous == nil {
+		return store.ErrPreviousNotSpecified
+	}
+	return c.atomicDelete(ctx, key, previous)
+}
+
+func (c *Proxy[T]) atomicDelete(ctx context.Context, key string, previous *store.KVPair) error {
+	target := path.Join(c.rootPath, key)
+	c.logger.Debugf("CAS DELETE:%s", target)
+	defer c.invalidateCache()
+	err := c.do(ctx, func() error {
+		_, err := withContext(ctx, c.kvstore).AtomicDelete(target, previous)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.forget(key)
+	if lease := c.currentLease(); lease != nil {
+		lease.unbind(target)
+	}
+	return nil
+}
+
+func isConflict(err error) bool {
+	return errors.Is(err, store.ErrKeyModified) || errors.Is(err, store.ErrKeyExists) || errors.Is(err, store.ErrKeyNotFound)
+}
+
+// Update reads key, applies fn and writes the result with compare and
+// swap, re-reading and retrying when another writer got in between.
+// fn gets nil when key does not exist, and deletes key by returning nil.
+func (c *Proxy[T]) Update(key string, fn func(old *T) (*T, error)) (*T, error) {
+	return c.UpdateContext(context.Background(), key, fn)
+}
+
+func (c *Proxy[T]) UpdateContext(ctx context.Context, key string, fn func(old *T) (*T, error)) (*T, error) {
+	var err error
+	for i := 0; i < MAX_UPDATE_RETRY_COUNT; i++ {
+		var old *T
+		var previous *store.KVPair
+		var kv *store.KVPair
+		gerr := c.do(ctx, func() (err error) {
+			kv, err = withContext(ctx, c.kvstore).Get(path.Join(c.rootPath, key))
+			return err
+		})
+		if gerr == nil {
+			if old, err = c.decode(kv.Value); err != nil {
+				return nil, err
+			}
+			previous = kv
+		} else if gerr != store.ErrKeyNotFound {
+			return nil, gerr
+		}
+		value, ferr := fn(old)
+		if ferr != nil {
+			return nil, ferr
+		}
+		if value == nil {
+			if previous == nil {
+				return nil, nil
+			}
+			err = c.atomicDelete(ctx, key, previous)
+		} else {
+			err = c.atomicPut(ctx, key, value, previous, c.currentLease())
+		}
+		if err == nil {
+			return value, nil
+		}
+		if !isConflict(err) {
+			return nil, err
+		}
+		c.logger.Debugf("UPDATE:%s conflict, retrying", path.Join(c.rootPath, key))
+	}
+	return nil, err
+}
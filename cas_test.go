@@ -0,0 +1,100 @@
+package kvstore
+
+import (
+	"github.com/shipdock/libkv/store"
+	"testing"
+)
+
+func TestCAS(t *testing.T) {
+	k, err := NewKVStore("mem:///r", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p1, err := NewCollectionProxy[Volume](k, nil, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := NewCollectionProxy[Volume](k, nil, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p1.Put("a", &Volume{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p1.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p2.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.PutIfUnchanged("a", &Volume{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p1.PutIfUnchanged("a", &Volume{Name: "c"}); err != store.ErrKeyModified {
+		t.Fatal(err)
+	}
+	v, err := p1.Update("a", func(old *Volume) (*Volume, error) { old.Driver = "d"; return old, nil })
+	if err != nil || v.Name != "b" {
+		t.Fatal(v, err)
+	}
+	if err := k.Store.Put("r/x/bad", []byte("{"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p1.Sync(map[string]*Volume{"bad": {Name: "ok"}}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := p1.List(true)
+	if err != nil || len(l) != 1 || l["bad"].Name != "ok" {
+		t.Fatal(l, err)
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	k, err := NewKVStore("mem:///r", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p, err := NewCollectionProxy[Volume](k, nil, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "h/b"} {
+		if err := p.Put(key, &Volume{Name: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put("a", &Volume{Name: "a2"}); err != nil {
+		t.Fatal(err)
+	}
+	if p.previous("a") != nil {
+		t.Fatal("Put kept the index")
+	}
+	for _, tc := range []struct {
+		recursive bool
+		a, hb     bool
+	}{
+		{true, true, true},
+		// a non recursive list only forgets the top level keys
+		{false, false, true},
+		{true, false, false},
+	} {
+		if _, err := p.List(tc.recursive); err != nil && err != store.ErrKeyNotFound {
+			t.Fatal(err)
+		}
+		if (p.previous("a") != nil) != tc.a || (p.previous("h/b") != nil) != tc.hb {
+			t.Fatal(tc, p.indexes)
+		}
+		if tc.a {
+			for _, key := range []string{"r/x/h/b", "r/x/a"} {
+				if err := k.Store.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
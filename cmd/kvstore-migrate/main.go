@@ -0,0 +1,58 @@
+// kvstore-migrate rewrites every record below the root path of a store
+// url to the current schema of its collection. The records are written
+// with schema envelopes (see kvstore.Options.SchemaEnvelope), run it once
+// every agent reads them.
+//
+//	kvstore-migrate consul://host:8500/shipdock
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/shipdock/kvstore"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+func main() {
+	timeout := flag.Duration("timeout", kvstore.DEFAULT_CONNECTION_TIMEOUT, "backend connection timeout")
+	parallelism := flag.Int("parallelism", 1, "concurrent rewrites")
+	verbose := flag.Bool("v", false, "log every key")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] store-url\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+	opts, err := kvstore.ParseOptions(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.ConnectionTimeout = *timeout
+	opts.SyncParallelism = *parallelism
+	opts.SchemaEnvelope = true
+	kv, err := kvstore.NewKVStoreWithOptions(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	start := time.Now()
+	result, err := kv.Migrate()
+	kv.Close()
+	if result != nil {
+		for _, key := range result.Updated {
+			log.Debugf("migrated %s", key)
+		}
+		log.Infof("migration of %s done in %s (%s)", opts.RootPath, time.Since(start), result)
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,205 @@
+package kvstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/shipdock/libkv/store"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"sync"
+)
+
+// Codec encodes the values stored by KVStore and the collections.
+// The built-in codecs decode every built-in or registered encoding
+// whatever they encode with, so readers keep working while writers
+// move from one codec to another.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Values of the non-JSON codecs start with a header naming their codec,
+// CODEC_MAGIC followed by the name and CODEC_MAGIC again. JSON values
+// are written bare, as before codecs were pluggable, and JSON never
+// starts with CODEC_MAGIC.
+const CODEC_MAGIC byte = 0x00
+
+type jsonCodec struct {
+	indent string
+}
+
+// prefixCodec writes the codec header in front of the encoded value.
+type prefixCodec struct {
+	name      string
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, v interface{}) error
+}
+
+var codecs = struct {
+	sync.RWMutex
+	named map[string]*prefixCodec
+}{named: make(map[string]*prefixCodec)}
+
+var (
+	JSONCodec       Codec = jsonCodec{}
+	IndentJSONCodec Codec = jsonCodec{indent: "  "}
+	GzipJSONCodec         = RegisterCodec("json-gzip", gzipJSONMarshal, gzipJSONUnmarshal)
+	ZstdJSONCodec         = RegisterCodec("json-zstd", zstdJSONMarshal, zstdJSONUnmarshal)
+	MsgpackCodec          = RegisterCodec("msgpack", msgpack.Marshal, msgpack.Unmarshal)
+)
+
+// RegisterCodec adds a codec to the ones every built-in codec can
+// decode. name goes into the header of each value and must not change
+// once values were written with it.
+func RegisterCodec(name string, marshal func(v interface{}) ([]byte, error), unmarshal func(data []byte, v interface{}) error) Codec {
+	c := &prefixCodec{name: name, marshal: marshal, unmarshal: unmarshal}
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.named[name] = c
+	return c
+}
+
+// checkCodec fails for the codecs with a header on etcd, whose v2 API
+// takes values as form fields and does not keep binary values intact.
+func checkCodec(backend store.Backend, codec Codec) error {
+	if c, ok := codec.(*prefixCodec); ok && backend == store.ETCD {
+		return fmt.Errorf("etcd: the %s codec writes binary values, use json or json-indent", c.name)
+	}
+	return nil
+}
+
+// CodecByName returns a codec for the codec= store url parameter:
+// json, json-indent or a registered name (json-gzip, json-zstd, msgpack).
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case "json":
+		return JSONCodec, nil
+	case "json-indent":
+		return IndentJSONCodec, nil
+	}
+	codecs.RLock()
+	defer codecs.RUnlock()
+	if c, ok := codecs.named[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown codec: %s", name)
+}
+
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	if len(c.indent) > 0 {
+		return json.MarshalIndent(v, "", c.indent)
+	}
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return unmarshal(data, v)
+}
+
+func (c *prefixCodec) Marshal(v interface{}) ([]byte, error) {
+	bv, err := c.marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, 0, len(c.name)+2+len(bv))
+	result = append(result, CODEC_MAGIC)
+	result = append(result, c.name...)
+	result = append(result, CODEC_MAGIC)
+	return append(result, bv...), nil
+}
+
+func (c *prefixCodec) Unmarshal(data []byte, v interface{}) error {
+	return unmarshal(data, v)
+}
+
+// unmarshal decodes data by its header, bare values are JSON.
+func unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 || data[0] != CODEC_MAGIC {
+		return json.Unmarshal(data, v)
+	}
+	end := bytes.IndexByte(data[1:], CODEC_MAGIC)
+	if end < 0 {
+		return fmt.Errorf("invalid codec header")
+	}
+	name := string(data[1 : end+1])
+	codecs.RLock()
+	c, ok := codecs.named[name]
+	codecs.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown codec: %s", name)
+	}
+	return c.unmarshal(data[end+2:], v)
+}
+
+func gzipJSONMarshal(v interface{}) ([]byte, error) {
+	bv, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(bv); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipJSONUnmarshal(data []byte, v interface{}) error {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	bv, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bv, v)
+}
+
+// the zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll, and expensive enough to share
+var zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func zstdInit() error {
+	zstdCodec.once.Do(func() {
+		if zstdCodec.encoder, zstdCodec.err = zstd.NewWriter(nil); zstdCodec.err != nil {
+			return
+		}
+		zstdCodec.decoder, zstdCodec.err = zstd.NewReader(nil)
+	})
+	return zstdCodec.err
+}
+
+func zstdJSONMarshal(v interface{}) ([]byte, error) {
+	if err := zstdInit(); err != nil {
+		return nil, err
+	}
+	bv, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return zstdCodec.encoder.EncodeAll(bv, nil), nil
+}
+
+func zstdJSONUnmarshal(data []byte, v interface{}) error {
+	if err := zstdInit(); err != nil {
+		return err
+	}
+	bv, err := zstdCodec.decoder.DecodeAll(data, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bv, v)
+}
@@ -0,0 +1,51 @@
+package kvstore
+
+import (
+	"github.com/shipdock/libkv/store"
+	"testing"
+)
+
+func TestCodecsMixed(t *testing.T) {
+	v := &Volume{Name: "v", Labels: map[string]string{"a": "b"}}
+	for _, c := range []Codec{JSONCodec, IndentJSONCodec, GzipJSONCodec, ZstdJSONCodec, MsgpackCodec} {
+		bv, err := c.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// any codec reads what the others wrote
+		for _, r := range []Codec{JSONCodec, MsgpackCodec} {
+			var out Volume
+			if err := r.Unmarshal(bv, &out); err != nil || out.Labels["a"] != "b" {
+				t.Fatal(err, out)
+			}
+		}
+	}
+	for _, tc := range []struct {
+		url string
+		ok  bool
+	}{
+		{"mem://x/root?codec=json-zstd", true},
+		{"mem://x/root?codec=bogus", false},
+	} {
+		if _, err := ParseOptions(tc.url); (err == nil) != tc.ok {
+			t.Fatal(tc.url, err)
+		}
+	}
+}
+
+func TestCheckCodec(t *testing.T) {
+	for _, tc := range []struct {
+		backend store.Backend
+		codec   Codec
+		ok      bool
+	}{
+		{store.ETCD, MsgpackCodec, false},
+		{store.ETCD, IndentJSONCodec, true},
+		{store.ETCD, nil, true},
+		{MEMORY, ZstdJSONCodec, true},
+	} {
+		if err := checkCodec(tc.backend, tc.codec); (err == nil) != tc.ok {
+			t.Fatal(tc.backend, tc.codec, err)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"github.com/shipdock/libkv/store"
+	"strings"
+	"time"
+)
+
+// CONSUL_TXN_MAX_OPS is the most operations consul accepts in one
+// transaction.
+const CONSUL_TXN_MAX_OPS = 64
+
+// consulStore talks to consul through its own api client, configured
+// like the libkv one (which does not expose its client), so that calls
+// take a context and transactions and sessions are available. The libkv
+// store is only kept to be closed.
+type consulStore struct {
+	store.Store
+	client *api.Client
+	// bounds the calls of the copies made by withContext
+	ctx context.Context
+}
+
+func newConsulStore(s store.Store, endpoint string, opts *Options) (store.Store, error) {
+	config := api.DefaultConfig()
+	config.Address = endpoint
+	if opts.TLS != nil {
+		config.Scheme = "https"
+		config.TLSConfig = api.TLSConfig{
+			Address:            opts.TLS.ServerName,
+			CAFile:             opts.TLS.CACertFile,
+			CertFile:           opts.TLS.CertFile,
+			KeyFile:            opts.TLS.KeyFile,
+			InsecureSkipVerify: opts.TLS.InsecureSkipVerify,
+		}
+	}
+	c, err := opts.credentials()
+	if err != nil {
+		return nil, err
+	}
+	if len(c.token) > 0 {
+		config.Token = c.token
+	}
+	if len(c.username) > 0 && len(c.password) > 0 {
+		config.HttpAuth = &api.HttpBasicAuth{Username: c.username, Password: c.password}
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("consul: %v", err)
+	}
+	return &consulStore{Store: s, client: client}, nil
+}
+
+func (c *consulStore) withContext(ctx context.Context) store.Store {
+	return &consulStore{Store: c.Store, client: c.client, ctx: ctx}
+}
+
+func (c *consulStore) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// query reads in consul's default consistency mode like the libkv
+// client, from the leader without a quorum round trip.
+func (c *consulStore) query() *api.QueryOptions {
+	return (&api.QueryOptions{}).WithContext(c.context())
+}
+
+func (c *consulStore) write() *api.WriteOptions {
+	return (&api.WriteOptions{}).WithContext(c.context())
+}
+
+// consulKey normalizes key like the libkv consul backend does.
+func consulKey(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+func consulPair(kv *api.KVPair) *store.KVPair {
+	return &store.KVPair{Key: kv.Key, Value: kv.Value, LastIndex: kv.ModifyIndex}
+}
+
+// consulPairs returns the pairs below directory, leaving out the
+// directory itself and, unless recursive, the nested keys.
+func consulPairs(kvs api.KVPairs, directory string, recursive bool) []*store.KVPair {
+	prefix := consulKey(directory) + "/"
+	pairs := make([]*store.KVPair, 0, len(kvs))
+	for _, kv := range kvs {
+		rel := strings.TrimPrefix(kv.Key, prefix)
+		if rel == kv.Key || len(rel) == 0 {
+			continue
+		}
+		if !recursive && strings.Contains(strings.TrimSuffix(rel, "/"), "/") {
+			continue
+		}
+		pairs = append(pairs, consulPair(kv))
+	}
+	return pairs
+}
+
+func (c *consulStore) Get(key string) (*store.KVPair, error) {
+	kv, _, err := c.client.KV().Get(consulKey(key), c.query())
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, store.ErrKeyNotFound
+	}
+	return consulPair(kv), nil
+}
+
+// Put ties a key with a TTL to a session, which deletes the key when it
+// is not renewed. Like the libkv client, the session already holding
+// the key is renewed and kept (with its own TTL), a new one is only
+// created for keys without a live session.
+func (c *consulStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	kv := &api.KVPair{Key: consulKey(key), Value: value}
+	if options == nil || options.TTL <= 0 {
+		_, err := c.client.KV().Put(kv, c.write())
+		return err
+	}
+	current, _, err := c.client.KV().Get(kv.Key, c.query())
+	if err != nil {
+		return err
+	}
+	if current != nil && len(current.Session) > 0 {
+		switch err := c.renew(c.context(), current.Session); err {
+		case nil:
+			kv.Session = current.Session
+		case ErrLeaseNotFound:
+		default:
+			return err
+		}
+	}
+	created := false
+	if len(kv.Session) == 0 {
+		if kv.Session, err = c.grant(c.context(), options.TTL); err != nil {
+			return err
+		}
+		created = true
+	}
+	ok, _, err := c.client.KV().Acquire(kv, c.write())
+	if err == nil && !ok {
+		err = fmt.Errorf("consul: %s is locked by another session", key)
+	}
+	if err != nil && created {
+		c.revoke(c.context(), kv.Session)
+	}
+	return err
+}
+
+func (c *consulStore) Delete(key string) error {
+	if _, err := c.Get(key); err != nil {
+		return err
+	}
+	_, err := c.client.KV().Delete(consulKey(key), c.write())
+	return err
+}
+
+func (c *consulStore) Exists(key string) (bool, error) {
+	_, err := c.Get(key)
+	if err == store.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *consulStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	kvs, _, err := c.client.KV().List(consulKey(directory)+"/", c.query())
+	if err != nil {
+		return nil, err
+	}
+	pairs := consulPairs(kvs, directory, recursive)
+	if len(pairs) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+// DeleteTree deletes directory and everything below it.
+func (c *consulStore) DeleteTree(directory string) error {
+	key := consulKey(directory)
+	kvs, _, err := c.client.KV().List(key, c.query())
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, kv := range kvs {
+		found = found || kv.Key == key || strings.HasPrefix(kv.Key, key+"/")
+	}
+	if !found {
+		return store.ErrKeyNotFound
+	}
+	if _, err := c.client.KV().Delete(key, c.write()); err != nil {
+		return err
+	}
+	_, err = c.client.KV().DeleteTree(key+"/", c.write())
+	return err
+}
+
+// AtomicPut ignores TTLs like the libkv client does.
+func (c *consulStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	kv := &api.KVPair{Key: consulKey(key), Value: value}
+	if previous != nil {
+		kv.ModifyIndex = previous.LastIndex
+	}
+	ok, _, err := c.client.KV().CAS(kv, c.write())
+	if err != nil {
+		return false, nil, err
+	}
+	if !ok {
+		if previous == nil {
+			return false, nil, store.ErrKeyExists
+		}
+		return false, nil, store.ErrKeyModified
+	}
+	written, err := c.Get(key)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, written, nil
+}
+
+func (c *consulStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+	if _, err := c.Get(key); err != nil {
+		return false, err
+	}
+	ok, _, err := c.client.KV().DeleteCAS(&api.KVPair{Key: consulKey(key), ModifyIndex: previous.LastIndex}, c.write())
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, store.ErrKeyModified
+	}
+	return true, nil
+}
+
+// stopContext is done when stopCh is closed or cancel is called.
+func stopContext(stopCh <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Watch follows key with blocking queries, the channel is closed when
+// stopCh is or a query fails.
+func (c *consulStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	ctx, cancel := stopContext(stopCh)
+	kv, meta, err := c.client.KV().Get(consulKey(key), (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	watchCh := make(chan *store.KVPair)
+	go func() {
+		defer cancel()
+		defer close(watchCh)
+		index := meta.LastIndex
+		for {
+			if kv != nil {
+				select {
+				case watchCh <- consulPair(kv):
+				case <-ctx.Done():
+					return
+				}
+			}
+			for {
+				kv, meta, err = c.client.KV().Get(consulKey(key), (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+				if err != nil {
+					return
+				}
+				if meta.LastIndex != index {
+					index = meta.LastIndex
+					break
+				}
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+// WatchTree follows directory with blocking queries, the channel is
+// closed when stopCh is or a query fails.
+func (c *consulStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	ctx, cancel := stopContext(stopCh)
+	prefix := consulKey(directory) + "/"
+	kvs, meta, err := c.client.KV().List(prefix, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	watchCh := make(chan []*store.KVPair)
+	go func() {
+		defer cancel()
+		defer close(watchCh)
+		index := meta.LastIndex
+		for {
+			select {
+			case watchCh <- consulPairs(kvs, directory, true):
+			case <-ctx.Done():
+				return
+			}
+			for {
+				kvs, meta, err = c.client.KV().List(prefix, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+				if err != nil {
+					return
+				}
+				if meta.LastIndex != index {
+					index = meta.LastIndex
+					break
+				}
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+type consulLock struct {
+	lock *api.Lock
+}
+
+func (l *consulLock) Lock(stopCh chan struct{}) (<-chan struct{}, error) {
+	return l.lock.Lock(stopCh)
+}
+
+func (l *consulLock) Unlock() error {
+	return l.lock.Unlock()
+}
+
+func (c *consulStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	opts := &api.LockOptions{Key: consulKey(key)}
+	if options != nil {
+		opts.Value = options.Value
+		if options.TTL > 0 {
+			opts.SessionTTL = options.TTL.String()
+		}
+	}
+	lock, err := c.client.LockOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &consulLock{lock: lock}, nil
+}
+
+func (c *consulStore) commit(ctx context.Context, ops []*txnOp) ([]*store.KVPair, error) {
+	txn := make(api.TxnOps, 0, len(ops))
+	// the op each txn entry belongs to, leased compare and swap takes two
+	owner := make([]int, 0, len(ops))
+	for i, op := range ops {
+		kv := &api.KVTxnOp{Key: consulKey(op.key), Value: op.value}
+		switch {
+		case op.verb == txnPut && op.lease != nil:
+			if op.cas {
+				check := &api.KVTxnOp{Verb: api.KVCheckNotExists, Key: kv.Key}
+				if op.previous != nil {
+					check.Verb = api.KVCheckIndex
+					check.Index = op.previous.LastIndex
+				}
+				txn = append(txn, &api.TxnOp{KV: check})
+				owner = append(owner, i)
+			}
+			// the session deletes the key when it is invalidated
+			kv.Verb = api.KVLock
+			kv.Session = op.lease.ID()
+		case op.verb == txnPut && op.cas:
+			// index 0 only creates
+			kv.Verb = api.KVCAS
+			if op.previous != nil {
+				kv.Index = op.previous.LastIndex
+			}
+		case op.verb == txnPut:
+			kv.Verb = api.KVSet
+		case op.cas:
+			if op.previous == nil {
+				return nil, &KeyError{Key: op.key, Err: store.ErrPreviousNotSpecified}
+			}
+			kv.Verb = api.KVDeleteCAS
+			kv.Index = op.previous.LastIndex
+		default:
+			kv.Verb = api.KVDelete
+		}
+		txn = append(txn, &api.TxnOp{KV: kv})
+		owner = append(owner, i)
+	}
+	if len(txn) > CONSUL_TXN_MAX_OPS {
+		return nil, fmt.Errorf("consul: a transaction takes at most %d operations (ops:%d)", CONSUL_TXN_MAX_OPS, len(txn))
+	}
+	ok, resp, _, err := c.client.Txn().Txn(txn, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if resp == nil || len(resp.Errors) == 0 {
+			return nil, fmt.Errorf("consul: transaction was rolled back")
+		}
+		e := resp.Errors[0]
+		if e.OpIndex < 0 || e.OpIndex >= len(owner) {
+			return nil, fmt.Errorf("consul: transaction was rolled back: %s", e.What)
+		}
+		op := ops[owner[e.OpIndex]]
+		if !op.cas {
+			return nil, &KeyError{Key: op.key, Err: fmt.Errorf("consul: %s", e.What)}
+		}
+		conflict := store.ErrKeyModified
+		if op.verb == txnPut && op.previous == nil {
+			conflict = store.ErrKeyExists
+		}
+		return nil, &KeyError{Key: op.key, Err: fmt.Errorf("%w (%s)", conflict, e.What)}
+	}
+	// deletes have no result entry, checks have one before the write
+	written := make(map[string]*api.KVPair)
+	if resp != nil {
+		for _, result := range resp.Results {
+			if result.KV != nil {
+				written[result.KV.Key] = result.KV
+			}
+		}
+	}
+	kvs := make([]*store.KVPair, len(ops))
+	for i, op := range ops {
+		if kv, ok := written[consulKey(op.key)]; ok && op.verb == txnPut {
+			kvs[i] = &store.KVPair{Key: kv.Key, Value: op.value, LastIndex: kv.ModifyIndex}
+		}
+	}
+	return kvs, nil
+}
+
+func (c *consulStore) grant(ctx context.Context, ttl time.Duration) (string, error) {
+	id, _, err := c.client.Session().Create(&api.SessionEntry{
+		Name:     "shipdock-kvstore",
+		TTL:      ttl.String(),
+		Behavior: api.SessionBehaviorDelete,
+		// let the next lease write the keys right away
+		LockDelay: time.Millisecond,
+	}, (&api.WriteOptions{}).WithContext(ctx))
+	return id, err
+}
+
+func (c *consulStore) renew(ctx context.Context, id string) error {
+	entry, _, err := c.client.Session().Renew(id, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return ErrLeaseNotFound
+	}
+	return nil
+}
+
+func (c *consulStore) revoke(ctx context.Context, id string) error {
+	_, err := c.client.Session().Destroy(id, (&api.WriteOptions{}).WithContext(ctx))
+	return err
+}
@@ -0,0 +1,122 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves the kv and session endpoints the TTL writes use
+type fakeConsul struct {
+	mu       sync.Mutex
+	values   map[string][]byte
+	holders  map[string]string
+	sessions map[string]bool
+	created  int
+	renewed  int
+	queries  []string
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, store.Store) {
+	f := &fakeConsul{values: make(map[string][]byte), holders: make(map[string]string), sessions: make(map[string]bool)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	s, err := newConsulStore(nil, strings.TrimPrefix(srv.URL, "http://"), &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("X-Consul-Index", "1")
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		f.queries = append(f.queries, r.URL.RawQuery)
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		value, ok := f.values[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"Key": key, "Value": value, "Session": f.holders[key], "ModifyIndex": 1}})
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		id := r.URL.Query().Get("acquire")
+		if holder := f.holders[key]; len(holder) > 0 && f.sessions[holder] && holder != id {
+			io.WriteString(w, "false")
+			return
+		}
+		f.values[key], _ = io.ReadAll(r.Body)
+		f.holders[key] = id
+		io.WriteString(w, "true")
+	case r.URL.Path == "/v1/session/create":
+		f.created++
+		id := fmt.Sprintf("s%d", f.created)
+		f.sessions[id] = true
+		fmt.Fprintf(w, `{"ID":%q}`, id)
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+		if !f.sessions[id] {
+			http.NotFound(w, r)
+			return
+		}
+		f.renewed++
+		fmt.Fprintf(w, `[{"ID":%q}]`, id)
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		delete(f.sessions, strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+		io.WriteString(w, "true")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestConsulPutTTL(t *testing.T) {
+	f, s := newFakeConsul(t)
+	ttl := &store.WriteOptions{TTL: time.Minute}
+	for _, tc := range []struct {
+		expire           bool
+		created, renewed int
+	}{
+		// the first write creates the session, the next ones renew it
+		{false, 1, 0},
+		{false, 1, 1},
+		{false, 1, 2},
+		// an expired session is replaced
+		{true, 2, 2},
+	} {
+		if tc.expire {
+			f.mu.Lock()
+			f.sessions = make(map[string]bool)
+			f.mu.Unlock()
+		}
+		if err := s.Put("root/a", []byte("v"), ttl); err != nil {
+			t.Fatal(err)
+		}
+		f.mu.Lock()
+		if f.created != tc.created || f.renewed != tc.renewed || len(f.sessions) != 1 {
+			t.Fatal(tc, f.created, f.renewed, f.sessions)
+		}
+		f.mu.Unlock()
+	}
+	kv, err := s.Get("root/a")
+	if err != nil || string(kv.Value) != "v" {
+		t.Fatal(kv, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, query := range f.queries {
+		if strings.Contains(query, "consistent") {
+			t.Fatal("consistent read", query)
+		}
+	}
+}
@@ -1,14 +1,10 @@
 package kvstore
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	types "github.com/docker/docker/api/types"
-	"os"
-	"path"
 	"path/filepath"
 	"strings"
-	"github.com/shipdock/libkv/store"
 )
 
 type NetInfo struct {
@@ -20,8 +16,8 @@ type NetInfo struct {
 }
 
 type MountInfo struct {
-	Name       string
-	Driver     string
+	Name   string
+	Driver string
 }
 
 type Container struct {
@@ -98,7 +94,7 @@ func NewContainer(base *types.Container, networks map[string]*Network) *Containe
 	}
 	for _, m := range base.Mounts {
 		c.Mounts[m.Name] = *&MountInfo{
-			Name: m.Name,
+			Name:   m.Name,
 			Driver: m.Driver,
 		}
 	}
@@ -106,109 +102,230 @@ func NewContainer(base *types.Container, networks map[string]*Network) *Containe
 }
 
 type Containers struct {
-	proxy *Proxy
+	proxy    *Proxy[Container]
 	networks *Networks
-	containersPath string
+	kvstore  *KVStore
 }
 
-func NewContainers(kvstore *KVStore, networks *Networks) (*Containers, error) {
-	hostname, err := os.Hostname()
+func newContainersProxy(kvstore *KVStore, node string) (*Proxy[Container], error) {
+	p, err := NewCollectionProxy[Container](kvstore, nil, "containers", node)
 	if err != nil {
 		return nil, err
 	}
-	rootPath := TrimRelative(filepath.Clean(path.Join(kvstore.RootPath, "containers", hostname)))
-	p, err := NewProxy(
-		kvstore,
-		rootPath,
-		func(v []byte) (interface{}, error) {
-			s := &Container{}
-			err := json.Unmarshal(v, s)
-			if err != nil {
-				return nil, err
-			}
-			return s, nil
-		}, nil)
+	if node == kvstore.Node && kvstore.agentLease != nil {
+		p.SetLease(kvstore.agentLease)
+	}
+	return p, nil
+}
+
+func NewContainers(kvstore *KVStore, networks *Networks) (*Containers, error) {
+	p, err := newContainersProxy(kvstore, kvstore.Node)
 	if err != nil {
 		return nil, err
 	}
+	cacheCollection(kvstore, p)
 	Container := &Containers{
-		proxy: p,
+		proxy:    p,
 		networks: networks,
-		containersPath: path.Join(kvstore.RootPath, "containers"),
+		kvstore:  kvstore,
 	}
 	return Container, nil
 }
 
 func (ss *Containers) Put(container *types.Container) error {
-	networks, err := ss.GetNetworkIDMap()
+	return ss.PutContext(context.Background(), container)
+}
+
+// PutContext stores container under this host, the lookup of its
+// network ids is bounded by ctx as well, see Proxy.PutContext
+func (ss *Containers) PutContext(ctx context.Context, container *types.Container) error {
+	networks, err := ss.networkIDMap(ctx)
 	if err != nil {
 		return err
 	}
 	c := NewContainer(container, networks)
-	return ss.proxy.Put(c.Name, c)
+	return ss.proxy.PutContext(ctx, c.Name, c)
 }
 
 func (ss *Containers) Delete(k string) error {
 	return ss.proxy.Delete(k)
 }
 
-func (ss *Containers) Get(k string) (*Container, error) {
-	v, err := ss.proxy.Get(k)
+func (ss *Containers) DeleteContext(ctx context.Context, k string) error {
+	return ss.proxy.DeleteContext(ctx, k)
+}
+
+// PutTxn queues the Put in txn, see KVStore.Begin
+func (ss *Containers) PutTxn(txn *Txn, container *types.Container) error {
+	networks, err := ss.GetNetworkIDMap()
 	if err != nil {
-		return nil, err
-	}
-	cv, ok := v.(*Container)
-	if !ok {
-		return nil, fmt.Errorf("type assertion failed")
+		return err
 	}
-	return cv, nil
+	c := NewContainer(container, networks)
+	return ss.proxy.PutTxn(txn, c.Name, c)
+}
+
+func (ss *Containers) DeleteTxn(txn *Txn, k string) error {
+	return ss.proxy.DeleteTxn(txn, k)
+}
+
+func (ss *Containers) Get(k string) (*Container, error) {
+	return ss.proxy.Get(k)
+}
+
+func (ss *Containers) GetContext(ctx context.Context, k string) (*Container, error) {
+	return ss.proxy.GetContext(ctx, k)
 }
 
 func (ss *Containers) List(recursive bool) (map[string]*Container, error) {
-	im, err := ss.proxy.List(recursive)
+	return ss.proxy.List(recursive)
+}
+
+func (ss *Containers) ListContext(ctx context.Context, recursive bool) (map[string]*Container, error) {
+	return ss.proxy.ListContext(ctx, recursive)
+}
+
+// ListWithFailures also returns the containers of this host which can
+// not be decoded, see ListAllWithFailures for the whole cluster
+func (ss *Containers) ListWithFailures(recursive bool) (map[string]*Container, []*DecodeFailure, error) {
+	return ss.proxy.ListWithFailures(recursive)
+}
+
+// GetNode returns a container of another host by its node identity
+func (ss *Containers) GetNode(node, k string) (*Container, error) {
+	if err := validateNode(node); err != nil {
+		return nil, err
+	}
+	p, err := newContainersProxy(ss.kvstore, node)
 	if err != nil {
 		return nil, err
 	}
-	rs := make(map[string]*Container)
-	for k, v := range im {
-		rs[k] = v.(*Container)
+	return p.Get(k)
+}
+
+// ListNode returns the container list of another host by its node identity
+func (ss *Containers) ListNode(node string) (map[string]*Container, error) {
+	if err := validateNode(node); err != nil {
+		return nil, err
+	}
+	p, err := newContainersProxy(ss.kvstore, node)
+	if err != nil {
+		return nil, err
 	}
-	return rs, nil
+	return p.List(true)
 }
 
 // List() returns this host's container list
-// ListAll returns all containers in this cluster
+// ListAll returns all containers in this cluster, keyed by host/name
+// (by name only with Options.LegacyListKeys)
 func (ss *Containers) ListAll() (map[string]*Container, error) {
-	kvs, err := ss.proxy.kvstore.List(ss.containersPath, true)
-	if err != nil && err != store.ErrKeyNotFound {
+	return ss.ListAllContext(context.Background())
+}
+
+func (ss *Containers) ListAllContext(ctx context.Context) (map[string]*Container, error) {
+	p, err := NewCollectionProxy[Container](ss.kvstore, nil, "containers")
+	if err != nil {
 		return nil, err
 	}
-	results := make(map[string]*Container)
-	for _, kv := range kvs {
-		c := &Container{}
-		if err := json.Unmarshal(kv.Value, c); err != nil {
-			continue
-		}
-		results[c.Name] = c
+	return p.ListContext(ctx, true)
+}
+
+// ListAllByKey is ListAll keyed by host and container name, also with
+// Options.LegacyListKeys.
+func (ss *Containers) ListAllByKey() (map[Key]*Container, error) {
+	p, err := NewCollectionProxy[Container](ss.kvstore, nil, "containers")
+	if err != nil {
+		return nil, err
 	}
-	return results, nil
+	p.SetLegacyKeys(false)
+	results, err := p.List(true)
+	if err != nil {
+		return nil, err
+	}
+	return ByKey(results), nil
 }
 
-func (ss *Containers) Sync(ls []types.Container) error {
-	lsm := make(map[string]interface{})
-	networks, err := ss.GetNetworkIDMap()
+// ListAllWithFailures is ListAll which also returns the values that
+// could not be decoded
+func (ss *Containers) ListAllWithFailures() (map[string]*Container, []*DecodeFailure, error) {
+	p, err := NewCollectionProxy[Container](ss.kvstore, nil, "containers")
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	return p.ListWithFailures(true)
+}
+
+// SetRetryPolicy applies to the containers of this host, GetNode,
+// ListNode and the ListAll variants keep the policy of the KVStore
+func (ss *Containers) SetRetryPolicy(policy *RetryPolicy) {
+	ss.proxy.SetRetryPolicy(policy)
+}
+
+func (ss *Containers) Watch(ctx context.Context) (<-chan Event[Container], error) {
+	return ss.proxy.Watch(ctx)
+}
+
+// WatchAll watches the containers of all hosts in this cluster
+func (ss *Containers) WatchAll(ctx context.Context) (<-chan Event[Container], error) {
+	p, err := NewCollectionProxy[Container](ss.kvstore, nil, "containers")
+	if err != nil {
+		return nil, err
+	}
+	return p.Watch(ctx)
+}
+
+func (ss *Containers) local(ctx context.Context, ls []types.Container) (map[string]*Container, error) {
+	lsm := make(map[string]*Container)
+	networks, err := ss.networkIDMap(ctx)
+	if err != nil {
+		return nil, err
 	}
 	for _, container := range ls {
 		c := NewContainer(&container, networks)
 		lsm[c.Name] = c
 	}
-	return ss.proxy.Sync(lsm)
+	return lsm, nil
+}
+
+// Plan returns what Sync(ls) would change without writing anything
+func (ss *Containers) Plan(ls []types.Container) (*Plan[Container], error) {
+	return ss.PlanContext(context.Background(), ls)
+}
+
+func (ss *Containers) PlanContext(ctx context.Context, ls []types.Container) (*Plan[Container], error) {
+	lsm, err := ss.local(ctx, ls)
+	if err != nil {
+		return nil, err
+	}
+	return ss.proxy.PlanContext(ctx, lsm)
+}
+
+func (ss *Containers) Apply(plan *Plan[Container]) (*SyncResult, error) {
+	return ss.proxy.Apply(plan)
+}
+
+func (ss *Containers) ApplyContext(ctx context.Context, plan *Plan[Container]) (*SyncResult, error) {
+	return ss.proxy.ApplyContext(ctx, plan)
+}
+
+func (ss *Containers) Sync(ls []types.Container) (*SyncResult, error) {
+	return ss.SyncContext(context.Background(), ls)
+}
+
+func (ss *Containers) SyncContext(ctx context.Context, ls []types.Container) (*SyncResult, error) {
+	lsm, err := ss.local(ctx, ls)
+	if err != nil {
+		return nil, err
+	}
+	return ss.proxy.SyncContext(ctx, lsm)
 }
 
 func (ss *Containers) GetNetworkIDMap() (map[string]*Network, error) {
-	base, err := ss.networks.List(true)
+	return ss.networkIDMap(context.Background())
+}
+
+func (ss *Containers) networkIDMap(ctx context.Context) (map[string]*Network, error) {
+	base, err := ss.networks.ListContext(ctx, true)
 	if err != nil {
 		return nil, err
 	}
@@ -217,4 +334,4 @@ func (ss *Containers) GetNetworkIDMap() (map[string]*Network, error) {
 		results[v.ID] = v
 	}
 	return results, nil
-}
\ No newline at end of file
+}
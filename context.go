@@ -0,0 +1,123 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/shipdock/libkv/store"
+)
+
+// contextual is implemented by the stores whose calls take a context
+// (consul, and the wrappers which may hold it), withContext returns a
+// view of the store bounding its calls by ctx.
+type contextual interface {
+	withContext(ctx context.Context) store.Store
+}
+
+// contextStore bounds the calls to the other stores by ctx. Their libkv
+// clients take no context, so reads still running when ctx is done are
+// left to finish in the background (the clients time out on their
+// ConnectionTimeout) and their results are dropped. Writes are only
+// checked against ctx before they start and are then waited for, so
+// that a write reported as given up on is never applied later.
+type contextStore struct {
+	store.Store
+	ctx context.Context
+}
+
+// withContext returns s bounded by ctx, s itself for contexts which are
+// never done.
+func withContext(ctx context.Context, s store.Store) store.Store {
+	if ctx == nil || ctx.Done() == nil {
+		return s
+	}
+	if cs, ok := s.(*contextStore); ok {
+		s = cs.Store
+	}
+	if cs, ok := s.(contextual); ok {
+		return cs.withContext(ctx)
+	}
+	return &contextStore{Store: s, ctx: ctx}
+}
+
+// call runs fn until ctx is done.
+func call[R any](ctx context.Context, fn func() (R, error)) (R, error) {
+	var zero R
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	type result struct {
+		r   R
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		r, err := fn()
+		resultCh <- result{r, err}
+	}()
+	select {
+	case res := <-resultCh:
+		return res.r, res.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+func (s *contextStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.Put(key, value, options)
+}
+
+func (s *contextStore) Get(key string) (*store.KVPair, error) {
+	return call(s.ctx, func() (*store.KVPair, error) {
+		return s.Store.Get(key)
+	})
+}
+
+func (s *contextStore) Delete(key string) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.Delete(key)
+}
+
+func (s *contextStore) Exists(key string) (bool, error) {
+	return call(s.ctx, func() (bool, error) {
+		return s.Store.Exists(key)
+	})
+}
+
+func (s *contextStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	return call(s.ctx, func() ([]*store.KVPair, error) {
+		return s.Store.List(directory, recursive)
+	})
+}
+
+func (s *contextStore) DeleteTree(directory string) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.DeleteTree(directory)
+}
+
+func (s *contextStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	if err := s.ctx.Err(); err != nil {
+		return false, nil, err
+	}
+	return s.Store.AtomicPut(key, value, previous, options)
+}
+
+func (s *contextStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if err := s.ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.Store.AtomicDelete(key, previous)
+}
+
+func (s *contextStore) commit(ctx context.Context, ops []*txnOp) ([]*store.KVPair, error) {
+	ts, ok := s.Store.(txnStore)
+	if !ok {
+		return nil, errTxnNotSupported
+	}
+	return ts.commit(ctx, ops)
+}
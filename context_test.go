@@ -0,0 +1,156 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"github.com/shipdock/libkv/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingStore holds reads until release is closed, like a backend
+// which stopped answering.
+type blockingStore struct {
+	store.Store
+	release chan struct{}
+}
+
+func (s *blockingStore) Get(key string) (*store.KVPair, error) {
+	<-s.release
+	return s.Store.Get(key)
+}
+
+func (s *blockingStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	<-s.release
+	return s.Store.List(directory, recursive)
+}
+
+func TestContextReads(t *testing.T) {
+	k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, RootPath: "root", NodeName: "h1", Collections: CollectionServices | CollectionNetworks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p := k.Networks.proxy
+	if err := p.PutContext(context.Background(), "n1", &Network{Name: "n1"}); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	p.kvstore = &blockingStore{Store: p.kvstore, release: release}
+	for _, tc := range []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{"Get", func(ctx context.Context) error { _, err := p.GetContext(ctx, "n1"); return err }},
+		{"List", func(ctx context.Context) error { _, err := k.Networks.ListContext(ctx, true); return err }},
+		{"Plan", func(ctx context.Context) error { _, err := p.PlanContext(ctx, nil); return err }},
+		{"Sync", func(ctx context.Context) error { _, err := k.Networks.SyncContext(ctx, nil); return err }},
+		{"Update", func(ctx context.Context) error {
+			_, err := p.UpdateContext(ctx, "n1", func(old *Network) (*Network, error) { return old, nil })
+			return err
+		}},
+		// waits for the service between reads which do not block
+		{"Services.Get", func(ctx context.Context) error { _, err := k.Services.GetContext(ctx, "missing", "id"); return err }},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := tc.call(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal(tc.name, err)
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Fatal(tc.name, "not given up on", time.Since(start))
+		}
+	}
+}
+
+func TestContextWrites(t *testing.T) {
+	k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, RootPath: "root", NodeName: "h1", Collections: CollectionNetworks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p := k.Networks.proxy
+	if err := p.Put("n1", &Network{Name: "n1"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		name string
+		call func() error
+	}{
+		{"Put", func() error { return p.PutContext(ctx, "a", &Network{Name: "a"}) }},
+		{"PutIfUnchanged", func() error { return p.PutIfUnchangedContext(ctx, "a", &Network{Name: "a"}) }},
+		{"Delete", func() error { return p.DeleteContext(ctx, "n1") }},
+		{"Apply", func() error {
+			res, err := p.ApplyContext(ctx, &Plan[Network]{Create: []Change[Network]{{Key: "a", New: &Network{Name: "a"}}}})
+			if err != nil && len(res.Failed) != 1 {
+				t.Fatal(res)
+			}
+			return err
+		}},
+	} {
+		if err := tc.call(); !errors.Is(err, context.Canceled) {
+			t.Fatal(tc.name, err)
+		}
+	}
+	l, err := p.List(false)
+	if err != nil || len(l) != 1 || l["n1"] == nil {
+		t.Fatal("a cancelled write was applied", l, err)
+	}
+}
+
+func TestConsulContext(t *testing.T) {
+	cancelled := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/kv/root/a" {
+			select {
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		if r.URL.Path == "/v1/kv/root/" {
+			w.Header().Set("X-Consul-Index", "7")
+			w.Write([]byte(`[{"Key":"root/","Value":null,"ModifyIndex":1},{"Key":"root/x","Value":"eyJhIjoxfQ==","ModifyIndex":5},{"Key":"root/h/y","Value":"e30=","ModifyIndex":6}]`))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	s, err := newConsulStore(nil, strings.TrimPrefix(srv.URL, "http://"), &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		directory string
+		recursive bool
+		n         int
+	}{
+		{"root", false, 1},
+		{"/root", true, 2},
+	} {
+		kvs, err := s.List(tc.directory, tc.recursive)
+		if err != nil || len(kvs) != tc.n || kvs[0].Key != "root/x" || kvs[0].LastIndex != 5 {
+			t.Fatal(tc, kvs, err)
+		}
+	}
+	// the request itself is cancelled, not only waited for
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := withContext(ctx, &supervisedStore{s: s}).Get("root/a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("request not cancelled")
+	}
+}
@@ -0,0 +1,138 @@
+package kvstore
+
+import (
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	ENV_USERNAME      = "SHIPDOCK_KV_USERNAME"
+	ENV_PASSWORD      = "SHIPDOCK_KV_PASSWORD"
+	ENV_TOKEN         = "SHIPDOCK_KV_TOKEN"
+	ENV_USERNAME_FILE = "SHIPDOCK_KV_USERNAME_FILE"
+	ENV_PASSWORD_FILE = "SHIPDOCK_KV_PASSWORD_FILE"
+	ENV_TOKEN_FILE    = "SHIPDOCK_KV_TOKEN_FILE"
+
+	DEFAULT_CREDENTIAL_REFRESH_INTERVAL = 30 * time.Second
+)
+
+type credentials struct {
+	username string
+	password string
+	token    string
+}
+
+// credentialsFromURL reads user:pass@ userinfo and the
+// username_file=, password_file= and token_file= query parameters.
+func credentialsFromURL(uri *url.URL, opts *Options) {
+	if uri.User != nil {
+		opts.Username = uri.User.Username()
+		opts.Password, _ = uri.User.Password()
+	}
+	query := uri.Query()
+	opts.UsernameFile = query.Get("username_file")
+	opts.PasswordFile = query.Get("password_file")
+	opts.TokenFile = query.Get("token_file")
+}
+
+// credential resolves one secret, in order of precedence: the value
+// itself, the file, the file named by envFile, the env variable.
+func credential(value, file, env, envFile string) (string, error) {
+	if len(value) > 0 {
+		return value, nil
+	}
+	if len(file) == 0 {
+		file = os.Getenv(envFile)
+	}
+	if len(file) > 0 {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("can not read credential file: %v", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return os.Getenv(env), nil
+}
+
+func (o *Options) credentials() (*credentials, error) {
+	var err error
+	c := &credentials{}
+	if c.username, err = credential(o.Username, o.UsernameFile, ENV_USERNAME, ENV_USERNAME_FILE); err != nil {
+		return nil, err
+	}
+	if c.password, err = credential(o.Password, o.PasswordFile, ENV_PASSWORD, ENV_PASSWORD_FILE); err != nil {
+		return nil, err
+	}
+	if c.token, err = credential(o.Token, o.TokenFile, ENV_TOKEN, ENV_TOKEN_FILE); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// apply sets the username and password of the libkv clients, the consul
+// token goes to the api client of consulStore only.
+func (c *credentials) apply(config *store.Config) {
+	if len(c.username) > 0 && len(c.password) > 0 {
+		config.Username = c.username
+		config.Password = c.password
+	}
+}
+
+func (o *Options) credentialFiles() []string {
+	files := make([]string, 0)
+	for _, file := range []string{
+		o.UsernameFile, o.PasswordFile, o.TokenFile,
+		os.Getenv(ENV_USERNAME_FILE), os.Getenv(ENV_PASSWORD_FILE), os.Getenv(ENV_TOKEN_FILE),
+	} {
+		if len(file) > 0 {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func modTimes(files []string) map[string]time.Time {
+	results := make(map[string]time.Time)
+	for _, file := range files {
+		// os.Stat follows the symlinks orchestrators swap on rotation
+		if fi, err := os.Stat(file); err == nil {
+			results[file] = fi.ModTime()
+		}
+	}
+	return results
+}
+
+// watchCredentials reconnects with freshly read credentials whenever one
+// of the credential files changes.
+func (k *KVStore) watchCredentials(files []string, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := modTimes(files)
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		current := modTimes(files)
+		changed := len(current) != len(last)
+		for file, t := range current {
+			if !last[file].Equal(t) {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		k.Logger().Infof("kvstore credential files changed, reconnecting")
+		if err := k.Reconnect(); err != nil {
+			k.Logger().Warnf("kvstore reconnect failed: %v", err)
+			continue
+		}
+		last = current
+	}
+}
@@ -0,0 +1,103 @@
+package kvstore
+
+import (
+	"github.com/shipdock/libkv/store"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCredential(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "password")
+	envFile := filepath.Join(dir, "env-password")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(envFile, []byte(" from-env-file "), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		value   string
+		file    string
+		env     string
+		envFile string
+		result  string
+		fails   bool
+	}{
+		{value: "value", file: file, env: "env", envFile: envFile, result: "value"},
+		{file: file, env: "env", envFile: envFile, result: "from-file"},
+		{env: "env", envFile: envFile, result: "from-env-file"},
+		{env: "env", result: "env"},
+		{},
+		{file: filepath.Join(dir, "missing"), env: "env", fails: true},
+		{envFile: filepath.Join(dir, "missing"), fails: true},
+	} {
+		t.Setenv(ENV_PASSWORD, tc.env)
+		t.Setenv(ENV_PASSWORD_FILE, tc.envFile)
+		result, err := credential(tc.value, tc.file, ENV_PASSWORD, ENV_PASSWORD_FILE)
+		if tc.fails {
+			if err == nil {
+				t.Fatal(tc, result)
+			}
+			continue
+		}
+		if err != nil || result != tc.result {
+			t.Fatal(tc, result, err)
+		}
+	}
+}
+
+func TestCredentialsFromURL(t *testing.T) {
+	for _, v := range []string{ENV_USERNAME, ENV_PASSWORD, ENV_TOKEN, ENV_USERNAME_FILE, ENV_PASSWORD_FILE, ENV_TOKEN_FILE} {
+		t.Setenv(v, "")
+	}
+	dir := t.TempDir()
+	token := filepath.Join(dir, "token")
+	if err := os.WriteFile(token, []byte("t1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := ParseOptions("consul://u:p@host:8500/root?token_file=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Username != "u" || opts.Password != "p" || opts.TokenFile != token {
+		t.Fatal(opts)
+	}
+	c, err := opts.credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, &credentials{username: "u", password: "p", token: "t1"}) {
+		t.Fatal(c)
+	}
+	if files := opts.credentialFiles(); !reflect.DeepEqual(files, []string{token}) {
+		t.Fatal(files)
+	}
+	config, err := opts.storeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "u" || config.Password != "p" {
+		t.Fatal(config)
+	}
+}
+
+func TestCredentialsApply(t *testing.T) {
+	for _, tc := range []struct {
+		credentials *credentials
+		username    string
+		password    string
+	}{
+		{credentials: &credentials{username: "u", password: "p"}, username: "u", password: "p"},
+		{credentials: &credentials{username: "u"}},
+		{credentials: &credentials{password: "p", token: "t"}},
+	} {
+		config := &store.Config{}
+		tc.credentials.apply(config)
+		if config.Username != tc.username || config.Password != tc.password {
+			t.Fatal(tc.credentials, config)
+		}
+	}
+}
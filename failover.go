@@ -0,0 +1,261 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"github.com/shipdock/libkv"
+	"github.com/shipdock/libkv/store"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// failoverStore spreads one logical store over several cluster members for
+// backends whose libkv client only talks to a single endpoint (consul).
+// Calls go to the current member and move on to the next one when the
+// member can not be reached.
+type failoverStore struct {
+	*failoverMembers
+	// bounds the calls of the copies made by withContext
+	ctx context.Context
+}
+
+type failoverMembers struct {
+	mu        sync.Mutex
+	backend   store.Backend
+	endpoints []string
+	config    *store.Config
+	stores    []store.Store
+	current   int
+	logger    log.FieldLogger
+	// wrap adapts each member store once it is connected
+	wrap func(endpoint string, s store.Store) (store.Store, error)
+}
+
+func newFailoverStore(backend store.Backend, endpoints []string, config *store.Config, logger log.FieldLogger, wrap func(endpoint string, s store.Store) (store.Store, error)) (store.Store, error) {
+	f := &failoverStore{failoverMembers: &failoverMembers{
+		backend:   backend,
+		endpoints: endpoints,
+		config:    config,
+		stores:    make([]store.Store, len(endpoints)),
+		logger:    logger,
+		wrap:      wrap,
+	}}
+	// the first member must be valid, the others are connected lazily
+	if _, _, err := f.get(0); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func isUnreachable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == store.ErrNotReachable {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// given up by the caller, not a timeout of the member
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (f *failoverStore) get(i int) (store.Store, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i < 0 {
+		i = f.current
+	}
+	if f.stores[i] == nil {
+		s, err := libkv.NewStore(f.backend, []string{f.endpoints[i]}, f.config)
+		if err != nil {
+			return nil, i, err
+		}
+		if f.wrap != nil {
+			if s, err = f.wrap(f.endpoints[i], s); err != nil {
+				return nil, i, err
+			}
+		}
+		f.stores[i] = s
+	}
+	return f.stores[i], i, nil
+}
+
+func (f *failoverStore) next(failed int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current != failed {
+		// someone else already moved on
+		return
+	}
+	f.current = (failed + 1) % len(f.endpoints)
+	f.logger.Warnf("kvstore endpoint %s is not reachable, failing over to %s", f.endpoints[failed], f.endpoints[f.current])
+}
+
+// do runs fn against the current member, trying every member once
+// before giving up with the last error.
+func (f *failoverStore) do(fn func(s store.Store) error) error {
+	var err error
+	for attempt := 0; attempt < len(f.endpoints); attempt++ {
+		s, i, cerr := f.get(-1)
+		if cerr != nil {
+			err = cerr
+		} else if err = fn(withContext(f.ctx, s)); !isUnreachable(err) {
+			return err
+		}
+		f.next(i)
+	}
+	return err
+}
+
+func (f *failoverStore) withContext(ctx context.Context) store.Store {
+	return &failoverStore{failoverMembers: f.failoverMembers, ctx: ctx}
+}
+
+func (f *failoverStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	return f.do(func(s store.Store) error {
+		return s.Put(key, value, options)
+	})
+}
+
+func (f *failoverStore) Get(key string) (*store.KVPair, error) {
+	var kv *store.KVPair
+	err := f.do(func(s store.Store) (err error) {
+		kv, err = s.Get(key)
+		return err
+	})
+	return kv, err
+}
+
+func (f *failoverStore) Delete(key string) error {
+	return f.do(func(s store.Store) error {
+		return s.Delete(key)
+	})
+}
+
+func (f *failoverStore) Exists(key string) (bool, error) {
+	var ok bool
+	err := f.do(func(s store.Store) (err error) {
+		ok, err = s.Exists(key)
+		return err
+	})
+	return ok, err
+}
+
+func (f *failoverStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	var ch <-chan *store.KVPair
+	err := f.do(func(s store.Store) (err error) {
+		ch, err = s.Watch(key, stopCh)
+		return err
+	})
+	return ch, err
+}
+
+func (f *failoverStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	var ch <-chan []*store.KVPair
+	err := f.do(func(s store.Store) (err error) {
+		ch, err = s.WatchTree(directory, stopCh)
+		return err
+	})
+	return ch, err
+}
+
+func (f *failoverStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	var l store.Locker
+	err := f.do(func(s store.Store) (err error) {
+		l, err = s.NewLock(key, options)
+		return err
+	})
+	return l, err
+}
+
+func (f *failoverStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	var kvs []*store.KVPair
+	err := f.do(func(s store.Store) (err error) {
+		kvs, err = s.List(directory, recursive)
+		return err
+	})
+	return kvs, err
+}
+
+func (f *failoverStore) DeleteTree(directory string) error {
+	return f.do(func(s store.Store) error {
+		return s.DeleteTree(directory)
+	})
+}
+
+func (f *failoverStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	var ok bool
+	var kv *store.KVPair
+	err := f.do(func(s store.Store) (err error) {
+		ok, kv, err = s.AtomicPut(key, value, previous, options)
+		return err
+	})
+	return ok, kv, err
+}
+
+func (f *failoverStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	var ok bool
+	err := f.do(func(s store.Store) (err error) {
+		ok, err = s.AtomicDelete(key, previous)
+		return err
+	})
+	return ok, err
+}
+
+func (f *failoverStore) commit(ctx context.Context, ops []*txnOp) ([]*store.KVPair, error) {
+	var kvs []*store.KVPair
+	err := f.do(func(s store.Store) (err error) {
+		if ts, ok := s.(txnStore); ok {
+			kvs, err = ts.commit(ctx, ops)
+			return err
+		}
+		return errTxnNotSupported
+	})
+	return kvs, err
+}
+
+func (f *failoverStore) grant(ctx context.Context, ttl time.Duration) (string, error) {
+	var id string
+	err := f.do(func(s store.Store) (err error) {
+		if ls, ok := s.(leaseStore); ok {
+			id, err = ls.grant(ctx, ttl)
+			return err
+		}
+		return ErrLeaseNotSupported
+	})
+	return id, err
+}
+
+func (f *failoverStore) renew(ctx context.Context, id string) error {
+	return f.do(func(s store.Store) error {
+		if ls, ok := s.(leaseStore); ok {
+			return ls.renew(ctx, id)
+		}
+		return ErrLeaseNotSupported
+	})
+}
+
+func (f *failoverStore) revoke(ctx context.Context, id string) error {
+	return f.do(func(s store.Store) error {
+		if ls, ok := s.(leaseStore); ok {
+			return ls.revoke(ctx, id)
+		}
+		return ErrLeaseNotSupported
+	})
+}
+
+func (f *failoverStore) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, s := range f.stores {
+		if s != nil {
+			s.Close()
+			f.stores[i] = nil
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package kvstore
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/shipdock/libkv/store"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const FILE store.Backend = "file"
+
+const FILE_INDEX = ".index"
+
+const FILE_INDEX_LOCK = ".index.lock"
+
+// fileStore keeps every key as a file below a root directory so the tree
+// can be inspected and diffed with ordinary tools. Writes go to a hidden
+// temporary file which is renamed over the key. LastIndex is kept in a
+// hidden .<key>.index file next to the key and taken from a counter of
+// the store in <root>/.index, which is shared with other stores on the
+// same root under a file lock. Files written by other tools have index 0
+// until they are written through the store. Atomic operations are only
+// atomic within this process, and TTLs are not supported, Put returns
+// an error for them.
+type fileStore struct {
+	mu       sync.Mutex
+	root     string
+	notifier *notifier
+	watcher  *fsnotify.Watcher
+}
+
+// NewFileStore creates a store rooted at the single endpoint directory.
+// It has the libkv.Initialize signature and is registered as FILE.
+func NewFileStore(endpoints []string, options *store.Config) (store.Store, error) {
+	if len(endpoints) != 1 || len(endpoints[0]) == 0 {
+		return nil, fmt.Errorf("file: exactly one root directory is required (endpoints:%v)", endpoints)
+	}
+	root := filepath.Clean(endpoints[0])
+	if err := os.MkdirAll(root, 0750); err != nil {
+		return nil, err
+	}
+	if _, err := readIndex(filepath.Join(root, FILE_INDEX)); err != nil {
+		return nil, err
+	}
+	return &fileStore{root: root, notifier: newNotifier()}, nil
+}
+
+// fileOptions reads file:///path/to/dir?root=... like boltdbOptions,
+// the url path is the directory holding the tree.
+func fileOptions(uri *url.URL, opts *Options) error {
+	if len(uri.Path) == 0 {
+		return fmt.Errorf("file: root directory is missing (url:%s)", uri)
+	}
+	opts.Endpoints = []string{uri.Path}
+	opts.RootPath = uri.Query().Get("root")
+	return nil
+}
+
+// path refuses keys which would leave the root, like "../x"
+func (s *fileStore) path(key string) (string, error) {
+	target := filepath.Join(s.root, filepath.FromSlash(memKey(key)))
+	rel, err := filepath.Rel(s.root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file: key %s is outside of the store root %s", key, s.root)
+	}
+	return target, nil
+}
+
+func (s *fileStore) key(path string) (string, bool) {
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func indexPath(target string) string {
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+FILE_INDEX)
+}
+
+func readIndex(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	index, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("file: invalid index %s: %v", path, err)
+	}
+	return index, nil
+}
+
+// nextIndex re-reads the counter under the lock of FILE_INDEX_LOCK, so
+// stores of other processes on the same root never hand out an index
+// twice.
+func (s *fileStore) nextIndex() (uint64, error) {
+	lock, err := os.OpenFile(filepath.Join(s.root, FILE_INDEX_LOCK), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, fmt.Errorf("file: cannot lock %s: %v", lock.Name(), err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	path := filepath.Join(s.root, FILE_INDEX)
+	index, err := readIndex(path)
+	if err != nil {
+		return 0, err
+	}
+	index++
+	if err := writeFile(path, []byte(strconv.FormatUint(index, 10))); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".")
+}
+
+// read takes the index before the value, write stores them the other
+// way round, so an unlocked read never pairs a new index with an old
+// value.
+func (s *fileStore) read(key string) (*store.KVPair, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	index, err := readIndex(indexPath(target))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, store.ErrKeyNotFound
+		}
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, store.ErrKeyNotFound
+	}
+	value, err := os.ReadFile(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, store.ErrKeyNotFound
+		}
+		return nil, err
+	}
+	return &store.KVPair{Key: memKey(key), Value: value, LastIndex: index}, nil
+}
+
+func writeFile(target string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// must be called with s.mu held
+func (s *fileStore) write(key string, value []byte) (*store.KVPair, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	index, err := s.nextIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(target, value); err != nil {
+		return nil, err
+	}
+	if err := writeFile(indexPath(target), []byte(strconv.FormatUint(index, 10))); err != nil {
+		return nil, err
+	}
+	s.notifier.changed(key)
+	return &store.KVPair{Key: memKey(key), Value: value, LastIndex: index}, nil
+}
+
+// remove must be called with s.mu held
+func (s *fileStore) remove(key string) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil {
+		return err
+	}
+	if err := os.Remove(indexPath(target)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.notifier.changed(key)
+	return nil
+}
+
+func (s *fileStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	if options != nil && options.TTL > 0 {
+		return fmt.Errorf("file: TTLs are not supported (key:%s)", key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.write(key, value)
+	return err
+}
+
+func (s *fileStore) Get(key string) (*store.KVPair, error) {
+	return s.read(key)
+}
+
+func (s *fileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.read(key); err != nil {
+		return err
+	}
+	return s.remove(key)
+}
+
+func (s *fileStore) Exists(key string) (bool, error) {
+	if _, err := s.read(key); err != nil {
+		if err == store.ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *fileStore) list(directory string, recursive bool) ([]*store.KVPair, error) {
+	base, err := s.path(directory)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(base)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, store.ErrKeyNotFound
+		}
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, store.ErrKeyNotFound
+	}
+	kvs := make([]*store.KVPair, 0)
+	err = filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == base {
+			return nil
+		}
+		if isHidden(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		key, ok := s.key(path)
+		if !ok {
+			return nil
+		}
+		kv, err := s.read(key)
+		if err != nil {
+			if err == store.ErrKeyNotFound {
+				return nil
+			}
+			return err
+		}
+		kvs = append(kvs, kv)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+	return kvs, nil
+}
+
+func (s *fileStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	return s.list(directory, recursive)
+}
+
+func (s *fileStore) DeleteTree(directory string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target, err := s.path(directory)
+	if err != nil {
+		return err
+	}
+	if target == s.root {
+		return fmt.Errorf("file: refusing to delete the store root %s", s.root)
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	// a leaf key has its index next to it
+	if err := os.Remove(indexPath(target)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.notifier.changed(directory)
+	return nil
+}
+
+func (s *fileStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.read(key)
+	if err != nil && err != store.ErrKeyNotFound {
+		return false, nil, err
+	}
+	if previous == nil {
+		if current != nil {
+			return false, nil, store.ErrKeyExists
+		}
+	} else {
+		if current == nil {
+			return false, nil, store.ErrKeyNotFound
+		}
+		if current.LastIndex != previous.LastIndex {
+			return false, nil, store.ErrKeyModified
+		}
+	}
+	kv, err := s.write(key, value)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, kv, nil
+}
+
+func (s *fileStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.read(key)
+	if err != nil {
+		return false, err
+	}
+	if current.LastIndex != previous.LastIndex {
+		return false, store.ErrKeyModified
+	}
+	if err := s.remove(key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// watch starts the fsnotify watcher on first use, so changes made by
+// other processes or by hand also reach Watch and WatchTree.
+func (s *fileStore) watch() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watcher != nil {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := addWatchDirs(watcher, s.root); err != nil {
+		watcher.Close()
+		return err
+	}
+	s.watcher = watcher
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if isHidden(event.Name) {
+					continue
+				}
+				if event.Has(fsnotify.Create) {
+					// fsnotify is not recursive, follow new directories
+					if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+						addWatchDirs(watcher, event.Name)
+					}
+				}
+				if key, ok := s.key(event.Name); ok {
+					s.notifier.changed(key)
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func addWatchDirs(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && isHidden(path) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+func (s *fileStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	if err := s.watch(); err != nil {
+		return nil, err
+	}
+	return s.notifier.watch(key, s.Get, stopCh), nil
+}
+
+func (s *fileStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	if err := s.watch(); err != nil {
+		return nil, err
+	}
+	return s.notifier.watchTree(directory, func(directory string) []*store.KVPair {
+		kvs, err := s.list(directory, true)
+		if err != nil {
+			return []*store.KVPair{}
+		}
+		return kvs
+	}, stopCh), nil
+}
+
+func (s *fileStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	if err := s.watch(); err != nil {
+		return nil, err
+	}
+	return newNotifyLock(s, s.notifier, memKey(key), options), nil
+}
+
+// Close ends the watches, so that their users move to the store which
+// replaces this one on reconnect.
+func (s *fileStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watcher != nil {
+		s.watcher.Close()
+		s.watcher = nil
+	}
+	s.notifier.close()
+}
@@ -0,0 +1,176 @@
+package kvstore
+
+import (
+	types "github.com/docker/docker/api/types"
+	"github.com/shipdock/libkv/store"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	k, err := NewKVStore("file://"+dir+"?root=shipdock", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	ch, err := k.Store.WatchTree("shipdock/volumes", stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+	if err := k.Volumes.Put(&types.Volume{Name: "v1", Driver: "local"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case l := <-ch:
+		if len(l) != 1 {
+			t.Fatal(l)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no watch event")
+	}
+	v, err := k.Volumes.Get("v1")
+	if err != nil || v.Driver != "local" {
+		t.Fatal(v, err)
+	}
+	if err := k.Remove("shipdock/volumes/"+k.Node+"/v1", true); err != nil {
+		t.Fatal(err)
+	}
+	if kvs, err := k.Store.List("shipdock", true); err == nil && len(kvs) != 0 {
+		t.Fatal(kvs)
+	}
+}
+
+func TestFileStoreIndex(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore([]string{dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var last uint64
+	for i := 0; i < 5; i++ {
+		if err := s.Put("a/b", []byte("v"), nil); err != nil {
+			t.Fatal(err)
+		}
+		kv, err := s.Get("a/b")
+		if err != nil || kv.LastIndex <= last {
+			t.Fatal(kv, err, last)
+		}
+		last = kv.LastIndex
+	}
+	old, err := s.Get("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := s.AtomicPut("a/b", []byte("w"), old, nil); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if _, _, err := s.AtomicPut("a/b", []byte("x"), old, nil); err != store.ErrKeyModified {
+		t.Fatal(err)
+	}
+	if kvs, err := s.List("a", false); err != nil || len(kvs) != 1 {
+		t.Fatal(kvs, err)
+	}
+	current, err := s.Get("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.AtomicDelete("a/b", current); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	s2, err := NewFileStore([]string{dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if err := s2.Put("a/b", []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if kv, err := s2.Get("a/b"); err != nil || kv.LastIndex <= current.LastIndex {
+		t.Fatal("index went back after reopening", kv, err, current.LastIndex)
+	}
+}
+
+func TestFileStoreSharedIndex(t *testing.T) {
+	dir := t.TempDir()
+	stores := make([]store.Store, 4)
+	for i := range stores {
+		s, err := NewFileStore([]string{dir}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		stores[i] = s
+	}
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i, s := range stores {
+		wg.Add(1)
+		go func(i int, s store.Store) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				_, kv, err := s.AtomicPut(string(rune('a'+i))+"/"+string(rune('a'+j)), []byte("v"), nil, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[kv.LastIndex] {
+					t.Errorf("index %d handed out twice", kv.LastIndex)
+				}
+				seen[kv.LastIndex] = true
+				mu.Unlock()
+			}
+		}(i, s)
+	}
+	wg.Wait()
+}
+
+func TestFileStoreRejects(t *testing.T) {
+	s, err := NewFileStore([]string{t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, tc := range []struct {
+		name string
+		call func() error
+	}{
+		{"get outside the root", func() error { _, err := s.Get("../x"); return err }},
+		{"put outside the root", func() error { return s.Put("a/../../x", []byte("v"), nil) }},
+		{"list outside the root", func() error { _, err := s.List("..", true); return err }},
+		{"delete tree outside the root", func() error { return s.DeleteTree("../..") }},
+		{"put with a ttl", func() error { return s.Put("a", []byte("v"), &store.WriteOptions{TTL: time.Second}) }},
+	} {
+		if err := tc.call(); err == nil || err == store.ErrKeyNotFound {
+			t.Fatal(tc.name, err)
+		}
+	}
+}
+
+func TestFileStoreDeleteTreeLeaf(t *testing.T) {
+	s, err := NewFileStore([]string{t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Put("a/b", []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteTree("a/b"); err != nil {
+		t.Fatal(err)
+	}
+	// a stale index would be handed to a file written later by hand
+	if err := writeFile(s.(*fileStore).root+"/a/b", []byte("w")); err != nil {
+		t.Fatal(err)
+	}
+	if kv, err := s.Get("a/b"); err != nil || kv.LastIndex != 0 {
+		t.Fatal(kv, err)
+	}
+}
@@ -0,0 +1,37 @@
+package kvstore
+
+import "strings"
+
+// Key is a key of a recursive listing split at its first segment, e.g.
+// host-a/web-1234abcd of Containers.ListAll. Host is empty for keys
+// with one segment.
+type Key struct {
+	Host string
+	Name string
+}
+
+// ParseKey splits a key of a recursive listing, leading and trailing
+// slashes are ignored.
+func ParseKey(key string) Key {
+	key = TrimRelative(key)
+	if i := strings.Index(key, "/"); i >= 0 {
+		return Key{Host: key[:i], Name: key[i+1:]}
+	}
+	return Key{Name: key}
+}
+
+func (k Key) String() string {
+	if len(k.Host) == 0 {
+		return k.Name
+	}
+	return k.Host + "/" + k.Name
+}
+
+// ByKey rekeys the results of a recursive List by Key.
+func ByKey[T any](m map[string]*T) map[Key]*T {
+	results := make(map[Key]*T, len(m))
+	for k, v := range m {
+		results[ParseKey(k)] = v
+	}
+	return results
+}
@@ -0,0 +1,91 @@
+package kvstore
+
+import "testing"
+
+func TestParseKey(t *testing.T) {
+	for _, tc := range []struct {
+		key  string
+		want Key
+	}{
+		{"a/b", Key{Host: "a", Name: "b"}},
+		{"/a/b/", Key{Host: "a", Name: "b"}},
+		{"x", Key{Name: "x"}},
+		{"/x/", Key{Name: "x"}},
+		// names may contain slashes, the host may not
+		{"h/a/b", Key{Host: "h", Name: "a/b"}},
+	} {
+		if got := ParseKey(tc.key); got != tc.want {
+			t.Fatalf("%q: %+v, want %+v", tc.key, got, tc.want)
+		}
+	}
+	if s := (Key{Host: "h", Name: "n"}).String(); s != "h/n" {
+		t.Fatal(s)
+	}
+	byKey := ByKey(map[string]*Volume{"h1/v": {Name: "v"}, "v": {Name: "v"}})
+	if len(byKey) != 2 || byKey[Key{Host: "h1", Name: "v"}] == nil || byKey[Key{Name: "v"}] == nil {
+		t.Fatal(byKey)
+	}
+}
+
+func TestRecursiveKeys(t *testing.T) {
+	for _, tc := range []struct {
+		legacy bool
+		keys   []string
+	}{
+		{false, []string{"h1/web", "h2/web"}},
+		// one of the two webs wins with the legacy keys
+		{true, []string{"web"}},
+	} {
+		k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, RootPath: "root", NodeName: "h1", LegacyListKeys: tc.legacy, Collections: CollectionContainers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"h1", "h2"} {
+			if err := k.Store.Put("root/containers/"+key+"/web", []byte(`{"Name":"web","ID":"`+key+`"}`), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		all, err := k.Containers.ListAll()
+		if err != nil || len(all) != len(tc.keys) {
+			t.Fatal(tc.legacy, all, err)
+		}
+		for _, key := range tc.keys {
+			if all[key] == nil {
+				t.Fatal(tc.legacy, key, all)
+			}
+		}
+		// ListAllByKey keeps host and name either way
+		byKey, err := k.Containers.ListAllByKey()
+		if err != nil || len(byKey) != 2 || byKey[Key{Host: "h2", Name: "web"}].ID != "h2" {
+			t.Fatal(tc.legacy, byKey, err)
+		}
+		k.Close()
+	}
+}
+
+func TestLegacyKeysIndexes(t *testing.T) {
+	k, err := NewKVStore("mem:///r", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p, err := NewCollectionProxy[Volume](k, nil, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetLegacyKeys(true)
+	if err := p.Put("h/a", &Volume{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := p.List(true)
+	if err != nil || l["a"] == nil {
+		t.Fatal(l, err)
+	}
+	// indexes stay keyed by the full relative key
+	if p.previous("h/a") == nil || p.previous("a") != nil {
+		t.Fatal(p.indexes)
+	}
+	if err := p.PutIfUnchanged("h/a", &Volume{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+}
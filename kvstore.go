@@ -1,17 +1,18 @@
 package kvstore
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"github.com/shipdock/libkv"
 	"github.com/shipdock/libkv/store"
+	"github.com/shipdock/libkv/store/boltdb"
 	"github.com/shipdock/libkv/store/consul"
 	"github.com/shipdock/libkv/store/etcd"
+	"github.com/shipdock/libkv/store/zookeeper"
 	log "github.com/sirupsen/logrus"
-	"net/url"
-	"strings"
-	"time"
+	"golang.org/x/time/rate"
 	"path"
+	"sync"
+	"time"
 )
 
 type KVStore struct {
@@ -22,122 +23,285 @@ type KVStore struct {
 	Containers *Containers
 	Nodes      *Nodes
 	RootPath   string
+	// Node is this host's identity in host-scoped paths
+	// (containers/<node>, volumes/<node>)
+	Node       string
+	logger     log.FieldLogger
+	codec      Codec
+	opts       *Options
+	supervised *supervisedStore
+	stopCh     chan struct{}
+	closeOnce  sync.Once
+	stateMu    sync.Mutex
+	state      ConnectionState
+	stateFuncs []StateChangeFunc
+	// guarded by stateMu as well
+	decodeFuncs []DecodeFailureFunc
+	// shared by all proxies, the rate limit protects the backend
+	syncParallelism int
+	syncLimiter     *rate.Limiter
+	syncBatchSize   int
+	agentLease      *Lease
+	// guarded by stateMu, see retry.go
+	retry *RetryPolicy
 }
 
 func NewKVStore(storeUrl, connectionTimeout, username, password string) (*KVStore, error) {
-	uri, err := url.Parse(storeUrl)
+	return NewKVStoreWithTLS(storeUrl, connectionTimeout, username, password, nil)
+}
+
+// NewKVStoreWithTLS is NewKVStore with TLS settings. tlsOptions takes
+// precedence over TLS query parameters in storeUrl, nil uses the url only.
+func NewKVStoreWithTLS(storeUrl, connectionTimeout, username, password string, tlsOptions *TLSOptions) (*KVStore, error) {
+	opts, err := ParseOptions(storeUrl)
 	if err != nil {
 		return nil, err
 	}
-	var backend store.Backend
-	switch scheme := strings.ToLower(uri.Scheme); scheme {
-	case "consul":
-		backend = store.CONSUL
-	case "etcd":
-		backend = store.ETCD
-	//case "zookeeper":
-	//	backend = store.ZK
-	//case "boltdb":
-	//	backend = store.BOLTDB
-	default:
-		return nil, fmt.Errorf("unsupported uri schema: %+v (url:%s)", uri, storeUrl)
-	}
-	config := &store.Config{}
 	if len(connectionTimeout) > 0 {
 		timeout, err := time.ParseDuration(connectionTimeout)
 		if err != nil {
 			return nil, err
 		}
-		config.ConnectionTimeout = timeout
-	} else {
-		config.ConnectionTimeout = (time.Second * 3)
+		opts.ConnectionTimeout = timeout
 	}
 	if len(username) > 0 && len(password) > 0 {
-		config.Username = username
-		config.Password = password
-	}
-	store, err := libkv.NewStore(
-		backend,
-		[]string{uri.Host},
-		config,
-	)
-	if err != nil {
-		return nil, err
+		opts.Username = username
+		opts.Password = password
 	}
-	kvstore := &KVStore{
-		Store:    store,
-		RootPath: uri.Path,
+	if tlsOptions != nil {
+		opts.TLS = tlsOptions
 	}
-	if services, err := NewServices(kvstore); err != nil {
+	return NewKVStoreWithOptions(opts)
+}
+
+func NewKVStoreWithOptions(options *Options) (*KVStore, error) {
+	// the defaults are filled in on a copy, the caller may reuse options
+	o := *options
+	opts := &o
+	if opts.Logger == nil {
+		opts.Logger = log.StandardLogger()
+	}
+	if err := checkBatchSize(opts.Backend, opts.SyncBatchSize, opts.AgentLeaseTTL > 0); err != nil {
 		return nil, err
-	} else {
-		kvstore.Services = services
 	}
-	if networks, err := NewNetworks(kvstore); err != nil {
+	if err := checkCodec(opts.Backend, opts.Codec); err != nil {
 		return nil, err
-	} else {
-		kvstore.Networks = networks
 	}
-	if volumes, err := NewVolumes(kvstore); err != nil {
+	s, err := openStore(opts)
+	if err != nil {
 		return nil, err
-	} else {
-		kvstore.Volumes = volumes
 	}
-	if containers, err := NewContainers(kvstore, kvstore.Networks); err != nil {
+	node, err := opts.node()
+	if err != nil {
+		s.Close()
 		return nil, err
-	} else {
-		kvstore.Containers = containers
 	}
-	if nodes, err := NewNodes(kvstore); err != nil {
+	supervised := &supervisedStore{s: s}
+	kvstore := &KVStore{
+		Store:           supervised,
+		RootPath:        opts.RootPath,
+		Node:            node,
+		logger:          opts.Logger,
+		codec:           opts.Codec,
+		opts:            opts,
+		supervised:      supervised,
+		stopCh:          make(chan struct{}),
+		syncParallelism: opts.SyncParallelism,
+		syncLimiter:     newLimiter(opts.SyncRateLimit, opts.SyncRateBurst),
+		syncBatchSize:   opts.SyncBatchSize,
+		retry:           opts.Retry,
+	}
+	if opts.AgentLeaseTTL > 0 {
+		if kvstore.agentLease, err = kvstore.Grant(opts.AgentLeaseTTL); err != nil {
+			kvstore.Close()
+			return nil, err
+		}
+	}
+	if opts.enabled(CollectionServices) {
+		if services, err := NewServices(kvstore); err != nil {
+			kvstore.Close()
+			return nil, err
+		} else {
+			kvstore.Services = services
+		}
+	}
+	if opts.enabled(CollectionNetworks | CollectionContainers) {
+		if networks, err := NewNetworks(kvstore); err != nil {
+			kvstore.Close()
+			return nil, err
+		} else {
+			kvstore.Networks = networks
+		}
+	}
+	if opts.enabled(CollectionVolumes) {
+		if volumes, err := NewVolumes(kvstore); err != nil {
+			kvstore.Close()
+			return nil, err
+		} else {
+			kvstore.Volumes = volumes
+		}
+	}
+	if opts.enabled(CollectionContainers) {
+		if containers, err := NewContainers(kvstore, kvstore.Networks); err != nil {
+			kvstore.Close()
+			return nil, err
+		} else {
+			kvstore.Containers = containers
+		}
+	}
+	if opts.enabled(CollectionNodes) {
+		if nodes, err := NewNodes(kvstore); err != nil {
+			kvstore.Close()
+			return nil, err
+		} else {
+			kvstore.Nodes = nodes
+		}
+	}
+	if opts.HealthCheckInterval > 0 {
+		failures := opts.ReconnectFailures
+		if failures <= 0 {
+			failures = DEFAULT_RECONNECT_FAILURES
+		}
+		go kvstore.supervise(opts.HealthCheckInterval, failures, kvstore.stopCh)
+	}
+	if files := opts.credentialFiles(); len(files) > 0 {
+		interval := opts.CredentialRefreshInterval
+		if interval <= 0 {
+			interval = DEFAULT_CREDENTIAL_REFRESH_INTERVAL
+		}
+		go kvstore.watchCredentials(files, interval, kvstore.stopCh)
+	}
+	return kvstore, nil
+}
+
+func openStore(opts *Options) (store.Store, error) {
+	config, err := opts.storeConfig()
+	if err != nil {
 		return nil, err
+	}
+	var s store.Store
+	if opts.Backend == store.CONSUL && len(opts.Endpoints) > 1 {
+		// libkv's consul client takes a single address only
+		s, err = newFailoverStore(opts.Backend, opts.Endpoints, config, opts.Logger, func(endpoint string, s store.Store) (store.Store, error) {
+			return newConsulStore(s, endpoint, opts)
+		})
 	} else {
-		kvstore.Nodes = nodes
+		s, err = libkv.NewStore(
+			opts.Backend,
+			opts.Endpoints,
+			config,
+		)
 	}
-	return kvstore, nil
+	if err != nil {
+		return nil, err
+	}
+	switch opts.Backend {
+	case store.CONSUL:
+		if len(opts.Endpoints) == 1 {
+			cs, err := newConsulStore(s, opts.Endpoints[0], opts)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			s = cs
+		}
+	case store.BOLTDB:
+		s = newBoltdbStore(s, opts.Endpoints[0])
+	case store.ZK:
+		s = newZookeeperStore(s)
+	}
+	return s, err
+}
+
+func (k *KVStore) backend() store.Backend {
+	if k.opts == nil {
+		return ""
+	}
+	return k.opts.Backend
+}
+
+func (k *KVStore) Logger() log.FieldLogger {
+	if k.logger == nil {
+		return log.StandardLogger()
+	}
+	return k.logger
+}
+
+// Codec returns the codec values are decoded with.
+func (k *KVStore) Codec() Codec {
+	if k.codec == nil {
+		return JSONCodec
+	}
+	return k.codec
 }
 
 func (k *KVStore) Close() {
-	k.Store.Close()
+	k.closeOnce.Do(func() {
+		if k.agentLease != nil {
+			if err := k.agentLease.Revoke(); err != nil {
+				k.Logger().Warnf("kvstore agent lease revoke failed: %v", err)
+			}
+		}
+		if k.stopCh != nil {
+			close(k.stopCh)
+		}
+		k.Store.Close()
+	})
 }
 
 func (k *KVStore) Put(key string, val interface{}) error {
-	log.Debugf("PUT:%s", key)
-	bv, err := json.Marshal(val)
+	return k.PutContext(context.Background(), key, val)
+}
+
+// PutContext is Put which gives up when ctx is done, a write given up
+// on may still be applied.
+func (k *KVStore) PutContext(ctx context.Context, key string, val interface{}) error {
+	k.Logger().Debugf("PUT:%s", key)
+	bv, err := k.Codec().Marshal(val)
 	if err != nil {
 		return err
 	}
-	if err := k.Store.Put(key, bv, &store.WriteOptions{IsDir: false}); err != nil {
-		return err
-	}
-	return nil
+	return k.retryPolicy().Do(ctx, func() error {
+		return withContext(ctx, k.Store).Put(key, bv, &store.WriteOptions{IsDir: false})
+	})
 }
 
 func (k *KVStore) RemoveEmptyDirectory(target string) error {
+	return removeEmptyDirectory(k.Store, target)
+}
+
+func removeEmptyDirectory(s store.Store, target string) error {
 	if target == "." || target == "/" {
 		return nil
 	}
-	kvs, err := k.Store.List(target, true)
-	if err != nil {
+	kvs, err := s.List(target, true)
+	if err != nil && err != store.ErrKeyNotFound {
 		return err
 	}
 	if len(kvs) > 0 {
 		return nil
 	}
-	if err := k.Store.DeleteTree(target); err != nil {
+	if err := s.DeleteTree(target); err != nil && err != store.ErrKeyNotFound {
 		return err
 	}
-	return k.RemoveEmptyDirectory(path.Dir(target))
+	return removeEmptyDirectory(s, path.Dir(target))
 }
 
 func (k *KVStore) Remove(key string, removeEmptyParents bool) error {
-	log.Debugf("DEL:%s", key)
-	if err := k.Store.DeleteTree(key); err != nil {
-		if err != store.ErrKeyNotFound {
-			return err
-		}
+	return k.RemoveContext(context.Background(), key, removeEmptyParents)
+}
+
+func (k *KVStore) RemoveContext(ctx context.Context, key string, removeEmptyParents bool) error {
+	k.Logger().Debugf("DEL:%s", key)
+	s := withContext(ctx, k.Store)
+	err := k.retryPolicy().Do(ctx, func() error {
+		return s.DeleteTree(key)
+	})
+	if err != nil && err != store.ErrKeyNotFound {
+		return err
 	}
 	if removeEmptyParents == true {
-		k.RemoveEmptyDirectory(path.Dir(key))
+		removeEmptyDirectory(s, path.Dir(key))
 	}
 	return nil
 }
@@ -145,6 +309,8 @@ func (k *KVStore) Remove(key string, removeEmptyParents bool) error {
 func init() {
 	consul.Register()
 	etcd.Register()
-	//zookeeper.Register()
-	//boltdb.Register()
+	zookeeper.Register()
+	boltdb.Register()
+	libkv.AddStore(MEMORY, NewMemStore)
+	libkv.AddStore(FILE, NewFileStore)
 }
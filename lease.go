@@ -0,0 +1,277 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_LEASE_TTL      = 15 * time.Second
+	LEASE_RENEWALS_PER_TTL = 3
+)
+
+var (
+	ErrLeaseNotFound     = errors.New("lease not found or expired")
+	ErrLeaseNotSupported = errors.New("leases are not supported by this store")
+)
+
+// leaseStore is implemented by the stores with server side leases (the
+// in-process store, and consul through sessions). Keys written with a
+// txnOp lease are deleted by the store when the lease expires or is
+// revoked. renew returns ErrLeaseNotFound for an expired lease.
+type leaseStore interface {
+	grant(ctx context.Context, ttl time.Duration) (string, error)
+	renew(ctx context.Context, id string) error
+	revoke(ctx context.Context, id string) error
+}
+
+// Lease ties keys to the liveness of this process. It is renewed in the
+// background every TTL/LEASE_RENEWALS_PER_TTL, so the keys disappear
+// about TTL after the process dies or loses the store.
+//
+// Consul implements leases as sessions with the delete behavior (the
+// keys are locked by the session), the in-process store natively. etcd
+// is spoken to through the v2 API which has per key TTLs only, there
+// the keys are written with the TTL and rewritten on every renewal,
+// which changes their index. The other backends have no expiry.
+//
+// When a lease expires anyway (after a network partition longer than
+// the TTL), it is granted again and the proxies using it rewrite their
+// keys on the next Sync.
+type Lease struct {
+	s       store.Store
+	ttl     time.Duration
+	logger  log.FieldLogger
+	emulate bool
+	mu      sync.Mutex
+	id      string
+	// keys written under the current id
+	keys      map[string]struct{}
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// Grant creates a lease and starts renewing it until Revoke.
+func (k *KVStore) Grant(ttl time.Duration) (*Lease, error) {
+	return k.GrantContext(context.Background(), ttl)
+}
+
+// GrantContext is Grant which gives up when ctx is done. Renewals are
+// bounded by their interval and Revoke by the TTL.
+func (k *KVStore) GrantContext(ctx context.Context, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		ttl = DEFAULT_LEASE_TTL
+	}
+	l := &Lease{
+		s:      k.Store,
+		ttl:    ttl,
+		logger: k.Logger(),
+		// libkv's etcd backend writes per key TTLs
+		emulate: k.opts != nil && k.opts.Backend == store.ETCD,
+		keys:    make(map[string]struct{}),
+		stopCh:  make(chan struct{}),
+	}
+	if err := l.grant(ctx); err != nil {
+		return nil, err
+	}
+	go l.keepAlive()
+	return l, nil
+}
+
+func (l *Lease) grant(ctx context.Context) error {
+	id := ""
+	if !l.emulate {
+		ls, ok := l.s.(leaseStore)
+		if !ok {
+			return ErrLeaseNotSupported
+		}
+		var err error
+		if id, err = ls.grant(ctx, l.ttl); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.id = id
+	l.keys = make(map[string]struct{})
+	return nil
+}
+
+func (l *Lease) TTL() time.Duration {
+	return l.ttl
+}
+
+// ID returns the backend id of the lease, empty for emulated leases.
+func (l *Lease) ID() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.id
+}
+
+// holds reports whether key was written under the current lease.
+func (l *Lease) holds(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.keys[key]
+	return ok
+}
+
+func (l *Lease) bind(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.keys[key] = struct{}{}
+}
+
+func (l *Lease) unbind(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+}
+
+func (l *Lease) keepAlive() {
+	interval := l.ttl / time.Duration(LEASE_RENEWALS_PER_TTL)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-ticker.C:
+		}
+		// a renewal hanging longer would miss the next one
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		l.renewOrGrant(ctx)
+		cancel()
+	}
+}
+
+// renewOrGrant renews the lease, and grants a new one when it expired.
+func (l *Lease) renewOrGrant(ctx context.Context) {
+	err := l.renew(ctx)
+	if err == nil {
+		return
+	}
+	if err != ErrLeaseNotFound {
+		l.logger.Warnf("kvstore lease renewal failed: %v", err)
+		return
+	}
+	l.logger.Warnf("kvstore lease %s expired, granting a new one", l.ID())
+	if err := l.grant(ctx); err != nil {
+		l.logger.Warnf("kvstore lease grant failed: %v", err)
+	}
+}
+
+func (l *Lease) renew(ctx context.Context) error {
+	if !l.emulate {
+		return l.s.(leaseStore).renew(ctx, l.ID())
+	}
+	s := withContext(ctx, l.s)
+	l.mu.Lock()
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	l.mu.Unlock()
+	for _, key := range keys {
+		kv, err := s.Get(key)
+		if err == nil {
+			_, _, err = s.AtomicPut(key, kv.Value, kv, &store.WriteOptions{TTL: l.ttl})
+		}
+		if err == store.ErrKeyNotFound {
+			// expired or deleted by someone else
+			l.unbind(key)
+			continue
+		}
+		if err != nil && err != store.ErrKeyModified {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Revoke stops the renewal and deletes the keys of the lease.
+func (l *Lease) Revoke() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.stopCh)
+		// the keys expire after the TTL anyway
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+		defer cancel()
+		err = l.revoke(ctx)
+	})
+	return err
+}
+
+func (l *Lease) revoke(ctx context.Context) error {
+	if !l.emulate {
+		return l.s.(leaseStore).revoke(ctx, l.ID())
+	}
+	s := withContext(ctx, l.s)
+	l.mu.Lock()
+	keys := l.keys
+	l.keys = make(map[string]struct{})
+	l.mu.Unlock()
+	for key := range keys {
+		if err := s.Delete(key); err != nil && err != store.ErrKeyNotFound {
+			l.logger.Warnf("kvstore lease revoke of %s failed: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// AgentLease returns the lease the host-scoped collections write with,
+// nil unless Options.AgentLeaseTTL is set.
+func (k *KVStore) AgentLease() *Lease {
+	return k.agentLease
+}
+
+// PutWithLease is Put with key tied to lease.
+func (k *KVStore) PutWithLease(key string, val interface{}, lease *Lease) error {
+	if lease == nil {
+		return fmt.Errorf("PutWithLease %s: lease is nil", key)
+	}
+	k.Logger().Debugf("PUT:%s lease:%s", key, lease.ID())
+	bv, err := k.Codec().Marshal(val)
+	if err != nil {
+		return err
+	}
+	txn := k.Begin()
+	if err := txn.add(&txnOp{verb: txnPut, key: key, value: bv, lease: lease}); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// SetLease makes every write of this proxy tie its key to lease, nil
+// writes without a lease again.
+func (c *Proxy[T]) SetLease(lease *Lease) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lease = lease
+}
+
+func (c *Proxy[T]) currentLease() *Lease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lease
+}
+
+// PutWithLease is Put with key tied to lease.
+func (c *Proxy[T]) PutWithLease(key string, value *T, lease *Lease) error {
+	return c.putWithLease(context.Background(), key, value, lease)
+}
+
+func (c *Proxy[T]) putWithLease(ctx context.Context, key string, value *T, lease *Lease) error {
+	return c.do(ctx, func() error {
+		txn := newTxn(c.kvstore, c.codec, c.logger)
+		if err := c.txnPut(txn, key, value, false, nil, lease); err != nil {
+			return err
+		}
+		return txn.CommitContext(ctx)
+	})
+}
@@ -0,0 +1,145 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const TEST_LEASE_TTL = 200 * time.Millisecond
+
+// eventually polls cond until it holds, failing after a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func openLeased(t *testing.T, name, node string, ttl time.Duration) *KVStore {
+	t.Helper()
+	k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{name}, RootPath: "root", NodeName: node, AgentLeaseTTL: ttl, Collections: CollectionVolumes, SchemaEnvelope: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestAgentLease(t *testing.T) {
+	// observer keeps the named store open while the agents come and go
+	observer := openLeased(t, "leasetest", "h0", time.Minute)
+	defer observer.Close()
+	exists := func(key string) bool {
+		ok, err := observer.Store.Exists(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	k := openLeased(t, "leasetest", "h1", TEST_LEASE_TTL)
+	defer k.Close()
+	p := k.Volumes.proxy
+	if _, err := p.Sync(map[string]*Volume{"v1": {Name: "v1"}}); err != nil {
+		t.Fatal(err)
+	}
+	// renew by hand instead of on the ticker, several TTLs long
+	lease := k.AgentLease()
+	lease.closeOnce.Do(func() { close(lease.stopCh) })
+	for start := time.Now(); time.Since(start) < 3*TEST_LEASE_TTL; time.Sleep(10 * time.Millisecond) {
+		lease.renewOrGrant(context.Background())
+		if !exists("root/volumes/h1/v1") {
+			t.Fatal("expired despite renewal")
+		}
+	}
+	// unchanged but not leased -> rewritten
+	if err := k.Store.Put("root/volumes/h1/v2", []byte(`{"_schema":1,"_value":{"Name":"v2"}}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := p.Plan(map[string]*Volume{"v1": {Name: "v1"}, "v2": {Name: "v2"}})
+	if err != nil || len(plan.Update) != 1 {
+		t.Fatal(plan, err)
+	}
+	// no more renewals: a dead agent
+	eventually(t, "the lease to expire", func() bool { return !exists("root/volumes/h1/v1") })
+	k2 := openLeased(t, "leasetest", "h2", time.Minute)
+	if err := k2.Volumes.proxy.Put("v3", &Volume{Name: "v3"}); err != nil {
+		t.Fatal(err)
+	}
+	k2.Close()
+	if exists("root/volumes/h2/v3") {
+		t.Fatal("not revoked on Close")
+	}
+	if _, err := NewKVStoreWithOptions(&Options{Backend: FILE, Endpoints: []string{t.TempDir()}, NodeName: "h1", AgentLeaseTTL: time.Second}); err != ErrLeaseNotSupported {
+		t.Fatal(err)
+	}
+}
+
+func TestPutWithLease(t *testing.T) {
+	k := openLeased(t, "", "h1", time.Minute)
+	defer k.Close()
+	for _, tc := range []struct {
+		lease *Lease
+		ok    bool
+	}{
+		{nil, false},
+		{k.AgentLease(), true},
+	} {
+		if err := k.PutWithLease("root/a", "v", tc.lease); (err == nil) != tc.ok {
+			t.Fatal(tc.lease, err)
+		}
+	}
+}
+
+func TestPlainWriteKeepsLease(t *testing.T) {
+	observer := openLeased(t, "plainlease", "h0", time.Minute)
+	defer observer.Close()
+	k := openLeased(t, "plainlease", "h1", time.Minute)
+	if err := k.Volumes.proxy.Put("v1", &Volume{Name: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Store.Put("root/volumes/h1/v1", []byte(`{"Name":"v1","Driver":"d"}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	k.Close()
+	if ok, err := observer.Store.Exists("root/volumes/h1/v1"); err != nil || ok {
+		t.Fatal("plain write dropped the lease", err)
+	}
+}
+
+func TestMigrateKeepsLeases(t *testing.T) {
+	observer := openLeased(t, "migratelease", "h0", time.Minute)
+	defer observer.Close()
+	k1, k2 := openLeased(t, "migratelease", "h1", time.Minute), openLeased(t, "migratelease", "h2", time.Minute)
+	if err := k1.Volumes.proxy.Put("v1", &Volume{Name: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k2.Volumes.proxy.Put("v2", &Volume{Name: "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	// rewrite both with bare values of schema 0
+	for key, value := range map[string]string{"root/volumes/h1/v1": `{"Name":"v1"}`, "root/volumes/h2/v2": `{"Name":"v2"}`} {
+		if err := k1.Store.Put(key, []byte(value), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := k1.Migrate()
+	if err != nil || len(r.Updated) != 2 {
+		t.Fatal(r, err)
+	}
+	for _, tc := range []struct {
+		agent *KVStore
+		key   string
+	}{
+		{k2, "root/volumes/h2/v2"},
+		{k1, "root/volumes/h1/v1"},
+	} {
+		tc.agent.Close()
+		if ok, err := observer.Store.Exists(tc.key); err != nil || ok {
+			t.Fatal("migrate dropped the lease of", tc.key, err)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/shipdock/libkv/store"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MEMORY store.Backend = "mem"
+
+// memStore is a thread-safe in-process store.Store. Stores created with
+// the same name (the host part of mem://name/root) share their data
+// until the last of them is closed, an unnamed store (mem:///root) is
+// private to its KVStore.
+type memStore struct {
+	// name and refs are guarded by memStores
+	name     string
+	refs     int
+	mu       sync.Mutex
+	index    uint64
+	data     map[string]*store.KVPair
+	timers   map[string]*time.Timer
+	notifier *notifier
+	// leases by id, and the lease each leased key is tied to. Writes
+	// without a lease keep it, like the keys locked by consul sessions.
+	leases map[string]*memLease
+	leased map[string]string
+}
+
+var memStores = struct {
+	sync.Mutex
+	named map[string]*memStore
+}{named: make(map[string]*memStore)}
+
+// NewMemStore creates an in-memory store. It has the libkv.Initialize
+// signature so it can be registered as the MEMORY backend, and can be
+// used directly by tests which want a store.Store without a KVStore.
+func NewMemStore(endpoints []string, options *store.Config) (store.Store, error) {
+	name := ""
+	if len(endpoints) > 0 {
+		name = endpoints[0]
+	}
+	memStores.Lock()
+	defer memStores.Unlock()
+	if len(name) == 0 {
+		s := newMemStore()
+		s.refs = 1
+		return s, nil
+	}
+	s, ok := memStores.named[name]
+	if !ok {
+		s = newMemStore()
+		s.name = name
+		memStores.named[name] = s
+	}
+	s.refs++
+	return s, nil
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		data:     make(map[string]*store.KVPair),
+		timers:   make(map[string]*time.Timer),
+		notifier: newNotifier(),
+		leases:   make(map[string]*memLease),
+		leased:   make(map[string]string),
+	}
+}
+
+func memKey(key string) string {
+	return strings.Trim(key, "/")
+}
+
+func memPrefix(directory string) string {
+	directory = memKey(directory)
+	if len(directory) == 0 {
+		return ""
+	}
+	return directory + "/"
+}
+
+func copyPair(kv *store.KVPair) *store.KVPair {
+	value := make([]byte, len(kv.Value))
+	copy(value, kv.Value)
+	return &store.KVPair{Key: kv.Key, Value: value, LastIndex: kv.LastIndex}
+}
+
+// must be called with s.mu held
+func (s *memStore) set(key string, value []byte, options *store.WriteOptions) *store.KVPair {
+	s.index++
+	v := make([]byte, len(value))
+	copy(v, value)
+	kv := &store.KVPair{Key: key, Value: v, LastIndex: s.index}
+	s.data[key] = kv
+	if timer, ok := s.timers[key]; ok {
+		timer.Stop()
+		delete(s.timers, key)
+	}
+	if options != nil && options.TTL > 0 {
+		index := kv.LastIndex
+		s.timers[key] = time.AfterFunc(options.TTL, func() {
+			s.expire(key, index)
+		})
+	}
+	s.notifier.changed(key)
+	return copyPair(kv)
+}
+
+// must be called with s.mu held
+func (s *memStore) remove(key string) {
+	delete(s.data, key)
+	delete(s.leased, key)
+	if timer, ok := s.timers[key]; ok {
+		timer.Stop()
+		delete(s.timers, key)
+	}
+	s.notifier.changed(key)
+}
+
+func (s *memStore) expire(key string, index uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the key was rewritten after the timer was armed
+	if kv, ok := s.data[key]; ok && kv.LastIndex == index {
+		s.remove(key)
+	}
+}
+
+func (s *memStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(memKey(key), value, options)
+	return nil
+}
+
+func (s *memStore) Get(key string) (*store.KVPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kv, ok := s.data[memKey(key)]
+	if !ok {
+		return nil, store.ErrKeyNotFound
+	}
+	return copyPair(kv), nil
+}
+
+func (s *memStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key = memKey(key)
+	if _, ok := s.data[key]; !ok {
+		return store.ErrKeyNotFound
+	}
+	s.remove(key)
+	return nil
+}
+
+func (s *memStore) Exists(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.data[memKey(key)]
+	return ok, nil
+}
+
+// must be called with s.mu held
+func (s *memStore) list(directory string, recursive bool) []*store.KVPair {
+	prefix := memPrefix(directory)
+	kvs := make([]*store.KVPair, 0)
+	for key, kv := range s.data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if !recursive && strings.Contains(strings.TrimPrefix(key, prefix), "/") {
+			continue
+		}
+		kvs = append(kvs, copyPair(kv))
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+	return kvs
+}
+
+func (s *memStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kvs := s.list(directory, recursive)
+	if len(kvs) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return kvs, nil
+}
+
+func (s *memStore) DeleteTree(directory string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	directory = memKey(directory)
+	prefix := memPrefix(directory)
+	for key := range s.data {
+		if key == directory || strings.HasPrefix(key, prefix) {
+			s.remove(key)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key = memKey(key)
+	current, ok := s.data[key]
+	if previous == nil {
+		if ok {
+			return false, nil, store.ErrKeyExists
+		}
+	} else {
+		if !ok {
+			return false, nil, store.ErrKeyNotFound
+		}
+		if current.LastIndex != previous.LastIndex {
+			return false, nil, store.ErrKeyModified
+		}
+	}
+	return true, s.set(key, value, options), nil
+}
+
+func (s *memStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key = memKey(key)
+	current, ok := s.data[key]
+	if !ok {
+		return false, store.ErrKeyNotFound
+	}
+	if current.LastIndex != previous.LastIndex {
+		return false, store.ErrKeyModified
+	}
+	s.remove(key)
+	return true, nil
+}
+
+func (s *memStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return s.notifier.watch(key, s.Get, stopCh), nil
+}
+
+func (s *memStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return s.notifier.watchTree(directory, func(directory string) []*store.KVPair {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.list(directory, true)
+	}, stopCh), nil
+}
+
+func (s *memStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return newNotifyLock(s, s.notifier, memKey(key), options), nil
+}
+
+// Close drops the data of the store with its last user, ending its
+// watches and expiries.
+func (s *memStore) Close() {
+	memStores.Lock()
+	if s.refs == 0 {
+		memStores.Unlock()
+		return
+	}
+	s.refs--
+	last := s.refs == 0
+	if last && len(s.name) > 0 {
+		delete(memStores.named, s.name)
+	}
+	memStores.Unlock()
+	if !last {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, timer := range s.timers {
+		timer.Stop()
+		delete(s.timers, key)
+	}
+	for id, lease := range s.leases {
+		lease.timer.Stop()
+		delete(s.leases, id)
+	}
+	s.notifier.close()
+}
+
+// commit checks every compare and swap first and then applies all ops
+// under the lock, so readers never see part of a transaction.
+func (s *memStore) commit(ctx context.Context, ops []*txnOp) ([]*store.KVPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, op := range ops {
+		current := s.data[memKey(op.key)]
+		if err := op.check(current); err != nil {
+			return nil, &KeyError{Key: op.key, Err: err}
+		}
+		if op.lease != nil && op.verb == txnPut {
+			if _, ok := s.leases[op.lease.ID()]; !ok {
+				return nil, &KeyError{Key: op.key, Err: ErrLeaseNotFound}
+			}
+		}
+	}
+	kvs := make([]*store.KVPair, len(ops))
+	for i, op := range ops {
+		key := memKey(op.key)
+		if op.verb == txnPut {
+			kvs[i] = s.set(key, op.value, nil)
+			if op.lease != nil {
+				s.leased[key] = op.lease.ID()
+			}
+		} else if _, ok := s.data[key]; ok {
+			s.remove(key)
+		}
+	}
+	return kvs, nil
+}
+
+type memLease struct {
+	ttl   time.Duration
+	timer *time.Timer
+}
+
+func (s *memStore) grant(ctx context.Context, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index++
+	id := strconv.FormatUint(s.index, 10)
+	s.leases[id] = &memLease{ttl: ttl, timer: time.AfterFunc(ttl, func() {
+		s.revoke(context.Background(), id)
+	})}
+	return id, nil
+}
+
+func (s *memStore) renew(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lease, ok := s.leases[id]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	lease.timer.Reset(lease.ttl)
+	return nil
+}
+
+// revoke deletes the lease and its keys, on expiry as well
+func (s *memStore) revoke(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lease, ok := s.leases[id]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	lease.timer.Stop()
+	delete(s.leases, id)
+	for key, owner := range s.leased {
+		if owner == id {
+			s.remove(key)
+		}
+	}
+	return nil
+}
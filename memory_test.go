@@ -0,0 +1,154 @@
+package kvstore
+
+import (
+	"github.com/shipdock/libkv/store"
+	"testing"
+	"time"
+)
+
+func TestMemStore(t *testing.T) {
+	s, err := NewMemStore(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Put("a/b/c", []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("a/d", []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if kvs, err := s.List("a", false); err != nil || len(kvs) != 1 {
+		t.Fatal(kvs, err)
+	}
+	if kvs, err := s.List("a", true); err != nil || len(kvs) != 2 {
+		t.Fatal(kvs, err)
+	}
+	kv, err := s.Get("a/d")
+	if err != nil || string(kv.Value) != "2" {
+		t.Fatal(kv, err)
+	}
+	if _, _, err := s.AtomicPut("a/d", []byte("3"), &store.KVPair{Key: "a/d", LastIndex: kv.LastIndex + 1}, nil); err != store.ErrKeyModified {
+		t.Fatal(err)
+	}
+	if ok, _, err := s.AtomicPut("a/d", []byte("3"), kv, nil); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if _, err := s.AtomicDelete("a/d", kv); err != store.ErrKeyModified {
+		t.Fatal(err)
+	}
+	if err := s.DeleteTree("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.List("a", true); err != store.ErrKeyNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestMemStoreWatchTree(t *testing.T) {
+	s, err := NewMemStore(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	ch, err := s.WatchTree("a", stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() []*store.KVPair {
+		select {
+		case kvs := <-ch:
+			return kvs
+		case <-time.After(2 * time.Second):
+			t.Fatal("no watch event")
+		}
+		return nil
+	}
+	if kvs := next(); len(kvs) != 0 {
+		t.Fatal(kvs)
+	}
+	if err := s.Put("a/e", []byte("1"), &store.WriteOptions{TTL: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if kvs := next(); len(kvs) != 1 {
+		t.Fatal(kvs)
+	}
+	// the TTL expiry is a change as well
+	if kvs := next(); len(kvs) != 0 {
+		t.Fatal(kvs)
+	}
+}
+
+func TestMemStoreLock(t *testing.T) {
+	s, err := NewMemStore(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	l1, err := s.NewLock("lock", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l1.Lock(nil); err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan error, 1)
+	go func() {
+		l2, err := s.NewLock("lock", nil)
+		if err == nil {
+			_, err = l2.Lock(nil)
+		}
+		locked <- err
+	}()
+	select {
+	case err := <-locked:
+		t.Fatal("locked twice", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := l1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemStoreNamed(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		shared bool
+	}{
+		{"", false},
+		{"memstore-named", true},
+	} {
+		s1, err := NewMemStore([]string{tc.name}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s1.Put("k", []byte("v"), nil); err != nil {
+			t.Fatal(err)
+		}
+		s2, err := NewMemStore([]string{tc.name}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := s2.Exists("k"); ok != tc.shared {
+			t.Fatalf("%q: shared %v, want %v", tc.name, ok, tc.shared)
+		}
+		s1.Close()
+		if ok, _ := s2.Exists("k"); ok != tc.shared {
+			t.Fatalf("%q: dropped before the last close", tc.name)
+		}
+		s2.Close()
+		s3, err := NewMemStore([]string{tc.name}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := s3.Exists("k"); ok {
+			t.Fatalf("%q: kept after the last close", tc.name)
+		}
+		s3.Close()
+	}
+}
@@ -0,0 +1,164 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"path"
+	"sort"
+)
+
+// Migrate rewrites the records below the proxy root, recursively, which
+// are older than the current schema of T. Keys in the result are
+// relative to the root. Each rewrite is compare and swap, a record
+// changed meanwhile fails and is left to the next run.
+//
+// Records keep their lease: the ones of this agent are rewritten under
+// its lease, the stores with server side leases keep the lease of the
+// others. On etcd, whose per key TTLs a rewrite would drop, records of
+// other agents are left to them when agent leases are in use.
+//
+// Migrate needs Options.SchemaEnvelope, without it the rewritten records
+// would not record their version.
+func (c *Proxy[T]) Migrate() (*SyncResult, error) {
+	return c.MigrateContext(context.Background())
+}
+
+func (c *Proxy[T]) MigrateContext(ctx context.Context) (*SyncResult, error) {
+	if !c.envelope {
+		return nil, fmt.Errorf("migrating %s: schema envelopes are disabled, see Options.SchemaEnvelope", c.rootPath)
+	}
+	result := &SyncResult{}
+	var kvs []*store.KVPair
+	err := c.do(ctx, func() (err error) {
+		kvs, err = withContext(ctx, c.kvstore).List(c.rootPath, true)
+		return err
+	})
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return result, nil
+		}
+		return nil, err
+	}
+	version := schemaOf[T]().version
+	stale := make([]*store.KVPair, 0)
+	leases := make([]*Lease, 0)
+	for _, kv := range kvs {
+		if len(kv.Value) == 0 {
+			continue
+		}
+		key := c.relative(kv.Key)
+		if c.schemaVersion(kv.Value) >= version {
+			result.Unchanged = append(result.Unchanged, key)
+			continue
+		}
+		lease, ok := c.migrationLease(key)
+		if !ok {
+			c.logger.Debugf("MIGRATE:%s may be leased by another agent, leaving it", key)
+			result.Unchanged = append(result.Unchanged, key)
+			continue
+		}
+		stale = append(stale, &store.KVPair{Key: key, Value: kv.Value, LastIndex: kv.LastIndex})
+		leases = append(leases, lease)
+	}
+	failures := c.each(ctx, len(stale), func(i int) error {
+		v, err := c.decode(stale[i].Value)
+		if err != nil {
+			return err
+		}
+		previous := &store.KVPair{Key: stale[i].Key, LastIndex: stale[i].LastIndex}
+		return c.atomicPut(ctx, stale[i].Key, v, previous, leases[i])
+	})
+	errs := make([]*KeyError, 0)
+	for i, kv := range stale {
+		if failures[i] != nil {
+			result.Failed = append(result.Failed, kv.Key)
+			errs = append(errs, &KeyError{Key: kv.Key, Err: failures[i]})
+			continue
+		}
+		result.Updated = append(result.Updated, kv.Key)
+	}
+	sort.Strings(result.Unchanged)
+	sort.Strings(result.Updated)
+	sort.Strings(result.Failed)
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool {
+			return errs[i].Key < errs[j].Key
+		})
+		return result, &SyncError{Errors: errs}
+	}
+	return result, nil
+}
+
+// migrationLease returns the lease key is rewritten under, false when
+// the rewrite would drop a lease.
+func (c *Proxy[T]) migrationLease(key string) (*Lease, bool) {
+	target := path.Join(c.rootPath, key)
+	for _, lease := range []*Lease{c.currentLease(), c.parent.agentLease} {
+		if lease != nil && lease.holds(target) {
+			return lease, true
+		}
+	}
+	if agent := c.parent.agentLease; agent != nil && agent.emulate {
+		return nil, false
+	}
+	return nil, true
+}
+
+// Migrate rewrites every collection below RootPath, of all hosts, to
+// the current schemas. Keys in the result are relative to RootPath.
+func (k *KVStore) Migrate() (*SyncResult, error) {
+	return k.MigrateContext(context.Background())
+}
+
+func (k *KVStore) MigrateContext(ctx context.Context) (*SyncResult, error) {
+	result := &SyncResult{}
+	errs := make([]*KeyError, 0)
+	merge := func(segment string, r *SyncResult, err error) error {
+		if r == nil {
+			return err
+		}
+		join := func(dst *[]string, keys []string) {
+			for _, key := range keys {
+				*dst = append(*dst, segment+"/"+key)
+			}
+		}
+		join(&result.Updated, r.Updated)
+		join(&result.Unchanged, r.Unchanged)
+		join(&result.Failed, r.Failed)
+		if serr, ok := err.(*SyncError); ok {
+			for _, e := range serr.Errors {
+				errs = append(errs, &KeyError{Key: segment + "/" + e.Key, Err: e.Err})
+			}
+		}
+		return nil
+	}
+	if err := migrateCollection[Service](ctx, k, "services", merge); err != nil {
+		return nil, err
+	}
+	if err := migrateCollection[Network](ctx, k, "networks", merge); err != nil {
+		return nil, err
+	}
+	if err := migrateCollection[Volume](ctx, k, "volumes", merge); err != nil {
+		return nil, err
+	}
+	if err := migrateCollection[Container](ctx, k, "containers", merge); err != nil {
+		return nil, err
+	}
+	if err := migrateCollection[Node](ctx, k, "nodes", merge); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return result, &SyncError{Errors: errs}
+	}
+	return result, nil
+}
+
+func migrateCollection[T any](ctx context.Context, k *KVStore, segment string, merge func(segment string, r *SyncResult, err error) error) error {
+	p, err := NewCollectionProxy[T](k, nil, segment)
+	if err != nil {
+		return err
+	}
+	r, err := p.MigrateContext(ctx)
+	return merge(segment, r, err)
+}
@@ -1,12 +1,9 @@
 package kvstore
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	types "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/network"
-	"path"
-	"path/filepath"
 )
 
 type Network struct {
@@ -42,25 +39,15 @@ func NewNetwork(base *types.NetworkResource) *Network {
 }
 
 type Networks struct {
-	proxy *Proxy
+	proxy *Proxy[Network]
 }
 
 func NewNetworks(kvstore *KVStore) (*Networks, error) {
-	rootPath := TrimRelative(filepath.Clean(path.Join(kvstore.RootPath, "networks")))
-	p, err := NewProxy(
-		kvstore,
-		rootPath,
-		func(v []byte) (interface{}, error) {
-			s := &Network{}
-			err := json.Unmarshal(v, s)
-			if err != nil {
-				return nil, err
-			}
-			return s, nil
-		}, nil)
+	p, err := NewCollectionProxy[Network](kvstore, nil, "networks")
 	if err != nil {
 		return nil, err
 	}
+	cacheCollection(kvstore, p)
 	n := &Networks{
 		proxy: p,
 	}
@@ -72,38 +59,91 @@ func (ss *Networks) Put(Network *types.NetworkResource) error {
 	return ss.proxy.Put(v.Name, v)
 }
 
+// PutContext stores Network by name, see Proxy.PutContext for ctx
+func (ss *Networks) PutContext(ctx context.Context, Network *types.NetworkResource) error {
+	v := NewNetwork(Network)
+	return ss.proxy.PutContext(ctx, v.Name, v)
+}
+
 func (ss *Networks) Delete(k string) error {
 	return ss.proxy.Delete(k)
 }
 
+func (ss *Networks) DeleteContext(ctx context.Context, k string) error {
+	return ss.proxy.DeleteContext(ctx, k)
+}
+
+// PutTxn queues the Put in txn, see KVStore.Begin
+func (ss *Networks) PutTxn(txn *Txn, Network *types.NetworkResource) error {
+	v := NewNetwork(Network)
+	return ss.proxy.PutTxn(txn, v.Name, v)
+}
+
+func (ss *Networks) DeleteTxn(txn *Txn, k string) error {
+	return ss.proxy.DeleteTxn(txn, k)
+}
+
 func (ss *Networks) Get(k string) (*Network, error) {
-	v, err := ss.proxy.Get(k)
-	if err != nil {
-		return nil, err
-	}
-	cv, ok := v.(*Network)
-	if !ok {
-		return nil, fmt.Errorf("type assertion failed")
-	}
-	return cv, nil
+	return ss.proxy.Get(k)
+}
+
+func (ss *Networks) GetContext(ctx context.Context, k string) (*Network, error) {
+	return ss.proxy.GetContext(ctx, k)
 }
 
 func (ss *Networks) List(recursive bool) (map[string]*Network, error) {
-	im, err := ss.proxy.List(recursive)
-	if err != nil {
-		return nil, err
-	}
-	rs := make(map[string]*Network)
-	for k, v := range im {
-		rs[k] = v.(*Network)
-	}
-	return rs, nil
+	return ss.proxy.List(recursive)
 }
 
-func (ss *Networks) Sync(ls []types.NetworkResource) error {
-	lsm := make(map[string]interface{})
+func (ss *Networks) ListContext(ctx context.Context, recursive bool) (map[string]*Network, error) {
+	return ss.proxy.ListContext(ctx, recursive)
+}
+
+// ListWithFailures also returns the networks which can not be decoded,
+// Containers resolves network ids with List and skips them
+func (ss *Networks) ListWithFailures(recursive bool) (map[string]*Network, []*DecodeFailure, error) {
+	return ss.proxy.ListWithFailures(recursive)
+}
+
+// SetRetryPolicy applies to the networks, including the network id
+// lookups of Containers.Put
+func (ss *Networks) SetRetryPolicy(policy *RetryPolicy) {
+	ss.proxy.SetRetryPolicy(policy)
+}
+
+func (ss *Networks) Watch(ctx context.Context) (<-chan Event[Network], error) {
+	return ss.proxy.Watch(ctx)
+}
+
+func (ss *Networks) local(ls []types.NetworkResource) map[string]*Network {
+	lsm := make(map[string]*Network)
 	for _, s := range ls {
 		lsm[s.Name] = NewNetwork(&s)
 	}
-	return ss.proxy.Sync(lsm)
+	return lsm
+}
+
+// Plan returns what Sync(ls) would change without writing anything
+func (ss *Networks) Plan(ls []types.NetworkResource) (*Plan[Network], error) {
+	return ss.proxy.Plan(ss.local(ls))
+}
+
+func (ss *Networks) PlanContext(ctx context.Context, ls []types.NetworkResource) (*Plan[Network], error) {
+	return ss.proxy.PlanContext(ctx, ss.local(ls))
+}
+
+func (ss *Networks) Apply(plan *Plan[Network]) (*SyncResult, error) {
+	return ss.proxy.Apply(plan)
+}
+
+func (ss *Networks) ApplyContext(ctx context.Context, plan *Plan[Network]) (*SyncResult, error) {
+	return ss.proxy.ApplyContext(ctx, plan)
+}
+
+func (ss *Networks) Sync(ls []types.NetworkResource) (*SyncResult, error) {
+	return ss.proxy.Sync(ss.local(ls))
+}
+
+func (ss *Networks) SyncContext(ctx context.Context, ls []types.NetworkResource) (*SyncResult, error) {
+	return ss.proxy.SyncContext(ctx, ss.local(ls))
 }
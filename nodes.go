@@ -1,15 +1,12 @@
 package kvstore
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"github.com/docker/docker/api/types/swarm"
-	"path"
-	"path/filepath"
 )
 
 type Nodes struct {
-	proxy *Proxy
+	proxy *Proxy[Node]
 }
 
 type Node struct {
@@ -41,21 +38,11 @@ func (ss *Nodes) NewNode(node *swarm.Node) *Node {
 }
 
 func NewNodes(kvstore *KVStore) (*Nodes, error) {
-	rootPath := TrimRelative(filepath.Clean(path.Join(kvstore.RootPath, "nodes")))
-	p, err := NewProxy(
-		kvstore,
-		rootPath,
-		func(v []byte) (interface{}, error) {
-			s := &Node{}
-			err := json.Unmarshal(v, s)
-			if err != nil {
-				return nil, err
-			}
-			return s, nil
-		}, nil)
+	p, err := NewCollectionProxy[Node](kvstore, nil, "nodes")
 	if err != nil {
 		return nil, err
 	}
+	cacheCollection(kvstore, p)
 	node := &Nodes{
 		proxy: p,
 	}
@@ -67,38 +54,91 @@ func (ss *Nodes) Put(node *swarm.Node) error {
 	return ss.proxy.Put(v.Hostname, v)
 }
 
+// PutContext stores node by hostname, see Proxy.PutContext for ctx
+func (ss *Nodes) PutContext(ctx context.Context, node *swarm.Node) error {
+	v := ss.NewNode(node)
+	return ss.proxy.PutContext(ctx, v.Hostname, v)
+}
+
 func (ss *Nodes) Delete(k string) error {
 	return ss.proxy.Delete(k)
 }
 
+func (ss *Nodes) DeleteContext(ctx context.Context, k string) error {
+	return ss.proxy.DeleteContext(ctx, k)
+}
+
+// PutTxn queues the Put in txn, see KVStore.Begin
+func (ss *Nodes) PutTxn(txn *Txn, node *swarm.Node) error {
+	v := ss.NewNode(node)
+	return ss.proxy.PutTxn(txn, v.Hostname, v)
+}
+
+func (ss *Nodes) DeleteTxn(txn *Txn, k string) error {
+	return ss.proxy.DeleteTxn(txn, k)
+}
+
 func (ss *Nodes) Get(k string) (*Node, error) {
-	v, err := ss.proxy.Get(k)
-	if err != nil {
-		return nil, err
-	}
-	cv, ok := v.(*Node)
-	if !ok {
-		return nil, fmt.Errorf("type assertion failed")
-	}
-	return cv, nil
+	return ss.proxy.Get(k)
+}
+
+func (ss *Nodes) GetContext(ctx context.Context, k string) (*Node, error) {
+	return ss.proxy.GetContext(ctx, k)
 }
 
 func (ss *Nodes) List(recursive bool) (map[string]*Node, error) {
-	im, err := ss.proxy.List(recursive)
-	if err != nil {
-		return nil, err
-	}
-	rs := make(map[string]*Node)
-	for k, v := range im {
-		rs[k] = v.(*Node)
-	}
-	return rs, nil
+	return ss.proxy.List(recursive)
 }
 
-func (ss *Nodes) Sync(ls []swarm.Node) error {
-	lsm := make(map[string]interface{})
+func (ss *Nodes) ListContext(ctx context.Context, recursive bool) (map[string]*Node, error) {
+	return ss.proxy.ListContext(ctx, recursive)
+}
+
+// ListWithFailures also returns the nodes which can not be decoded,
+// keyed by hostname like List
+func (ss *Nodes) ListWithFailures(recursive bool) (map[string]*Node, []*DecodeFailure, error) {
+	return ss.proxy.ListWithFailures(recursive)
+}
+
+// SetRetryPolicy applies to the node records, see
+// Proxy.SetRetryPolicy
+func (ss *Nodes) SetRetryPolicy(policy *RetryPolicy) {
+	ss.proxy.SetRetryPolicy(policy)
+}
+
+func (ss *Nodes) Watch(ctx context.Context) (<-chan Event[Node], error) {
+	return ss.proxy.Watch(ctx)
+}
+
+func (ss *Nodes) local(ls []swarm.Node) map[string]*Node {
+	lsm := make(map[string]*Node)
 	for _, s := range ls {
 		lsm[s.Description.Hostname] = ss.NewNode(&s)
 	}
-	return ss.proxy.Sync(lsm)
+	return lsm
+}
+
+// Plan returns what Sync(ls) would change without writing anything
+func (ss *Nodes) Plan(ls []swarm.Node) (*Plan[Node], error) {
+	return ss.proxy.Plan(ss.local(ls))
+}
+
+func (ss *Nodes) PlanContext(ctx context.Context, ls []swarm.Node) (*Plan[Node], error) {
+	return ss.proxy.PlanContext(ctx, ss.local(ls))
+}
+
+func (ss *Nodes) Apply(plan *Plan[Node]) (*SyncResult, error) {
+	return ss.proxy.Apply(plan)
+}
+
+func (ss *Nodes) ApplyContext(ctx context.Context, plan *Plan[Node]) (*SyncResult, error) {
+	return ss.proxy.ApplyContext(ctx, plan)
+}
+
+func (ss *Nodes) Sync(ls []swarm.Node) (*SyncResult, error) {
+	return ss.proxy.Sync(ss.local(ls))
+}
+
+func (ss *Nodes) SyncContext(ctx context.Context, ls []swarm.Node) (*SyncResult, error) {
+	return ss.proxy.SyncContext(ctx, ss.local(ls))
 }
@@ -0,0 +1,209 @@
+package kvstore
+
+import (
+	"github.com/shipdock/libkv/store"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifier implements Watch, WatchTree and NewLock for the in-process
+// backends (mem, file): writers call changed, watchers re-read the key
+// or tree and deliver the latest state.
+type notifier struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+	// closed ends every watch when the store is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type watcher struct {
+	key    string
+	tree   bool
+	notify chan struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{watchers: make(map[*watcher]struct{}), closed: make(chan struct{})}
+}
+
+func (n *notifier) close() {
+	n.closeOnce.Do(func() {
+		close(n.closed)
+	})
+}
+
+func (n *notifier) add(key string, tree bool) *watcher {
+	w := &watcher{key: memKey(key), tree: tree, notify: make(chan struct{}, 1)}
+	// deliver the current state first
+	w.notify <- struct{}{}
+	n.mu.Lock()
+	n.watchers[w] = struct{}{}
+	n.mu.Unlock()
+	return w
+}
+
+func (n *notifier) remove(w *watcher) {
+	n.mu.Lock()
+	delete(n.watchers, w)
+	n.mu.Unlock()
+}
+
+// changed wakes up the watchers of key, of the trees holding key and,
+// when key is a removed directory, of everything below it.
+func (n *notifier) changed(key string) {
+	key = memKey(key)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for w := range n.watchers {
+		if w.key == key ||
+			(w.tree && strings.HasPrefix(key, memPrefix(w.key))) ||
+			strings.HasPrefix(w.key, memPrefix(key)) {
+			select {
+			case w.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (n *notifier) watch(key string, get func(key string) (*store.KVPair, error), stopCh <-chan struct{}) <-chan *store.KVPair {
+	w := n.add(key, false)
+	watchCh := make(chan *store.KVPair)
+	go func() {
+		defer close(watchCh)
+		defer n.remove(w)
+		var last uint64
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-n.closed:
+				return
+			case <-w.notify:
+			}
+			kv, err := get(key)
+			if err != nil || kv.LastIndex == last {
+				continue
+			}
+			last = kv.LastIndex
+			select {
+			case watchCh <- kv:
+			case <-stopCh:
+				return
+			case <-n.closed:
+				return
+			}
+		}
+	}()
+	return watchCh
+}
+
+func (n *notifier) watchTree(directory string, list func(directory string) []*store.KVPair, stopCh <-chan struct{}) <-chan []*store.KVPair {
+	w := n.add(directory, true)
+	watchCh := make(chan []*store.KVPair)
+	go func() {
+		defer close(watchCh)
+		defer n.remove(w)
+		var last []*store.KVPair
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-n.closed:
+				return
+			case <-w.notify:
+			}
+			kvs := list(directory)
+			if last != nil && samePairs(last, kvs) {
+				continue
+			}
+			last = kvs
+			select {
+			case watchCh <- kvs:
+			case <-stopCh:
+				return
+			case <-n.closed:
+				return
+			}
+		}
+	}()
+	return watchCh
+}
+
+// samePairs compares two sorted lists by key and index
+func samePairs(a, b []*store.KVPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].LastIndex != b[i].LastIndex {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyLock is a lock key created with AtomicPut, waiting for the
+// holder to delete it.
+type notifyLock struct {
+	s      store.Store
+	n      *notifier
+	key    string
+	value  []byte
+	ttl    time.Duration
+	mu     sync.Mutex
+	held   *store.KVPair
+	lostCh chan struct{}
+}
+
+func newNotifyLock(s store.Store, n *notifier, key string, options *store.LockOptions) *notifyLock {
+	l := &notifyLock{s: s, n: n, key: key}
+	if options != nil {
+		l.value = options.Value
+		l.ttl = options.TTL
+	}
+	return l
+}
+
+func (l *notifyLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+	w := l.n.add(l.key, false)
+	defer l.n.remove(w)
+	for {
+		select {
+		case <-stopChan:
+			return nil, store.ErrCannotLock
+		case <-l.n.closed:
+			return nil, store.ErrCannotLock
+		case <-w.notify:
+		}
+		_, kv, err := l.s.AtomicPut(l.key, l.value, nil, &store.WriteOptions{TTL: l.ttl})
+		if err == store.ErrKeyExists {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+		l.held = kv
+		l.lostCh = make(chan struct{})
+		l.mu.Unlock()
+		return l.lostCh, nil
+	}
+}
+
+func (l *notifyLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held == nil {
+		return nil
+	}
+	_, err := l.s.AtomicDelete(l.key, l.held)
+	close(l.lostCh)
+	l.held = nil
+	if err != nil && err != store.ErrKeyNotFound && err != store.ErrKeyModified {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package kvstore
+
+import (
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const DEFAULT_CONNECTION_TIMEOUT = 3 * time.Second
+const ENV_NODE_NAME = "SHIPDOCK_NODE_NAME"
+
+type Collection uint
+
+const (
+	CollectionServices Collection = 1 << iota
+	CollectionNetworks
+	CollectionVolumes
+	CollectionContainers
+	CollectionNodes
+
+	AllCollections = CollectionServices | CollectionNetworks | CollectionVolumes | CollectionContainers | CollectionNodes
+)
+
+type Options struct {
+	Backend   store.Backend
+	Endpoints []string
+	RootPath  string
+	// boltdb only
+	Bucket            string
+	PersistConnection bool
+
+	ConnectionTimeout time.Duration
+	// Username, Password and the consul ACL Token fall back to the
+	// *File fields, then to the SHIPDOCK_KV_* environment variables.
+	// Files are re-read every CredentialRefreshInterval (30s when zero)
+	// and the store reconnects when they change.
+	Username                  string
+	Password                  string
+	Token                     string
+	UsernameFile              string
+	PasswordFile              string
+	TokenFile                 string
+	CredentialRefreshInterval time.Duration
+	TLS                       *TLSOptions
+
+	// HealthCheckInterval starts a supervisor pinging the backend at this
+	// interval, which rebuilds the store after ReconnectFailures
+	// consecutive failures (3 when zero). Disabled when zero.
+	HealthCheckInterval time.Duration
+	ReconnectFailures   int
+
+	// SyncParallelism is the number of concurrent backend writes of
+	// Sync/Apply and decoders of List (sequential when zero).
+	// SyncRateLimit caps those writes at that many per second for the
+	// whole KVStore, with bursts of SyncRateBurst (unlimited when zero).
+	SyncParallelism int
+	SyncRateLimit   float64
+	SyncRateBurst   int
+	// AgentLeaseTTL ties the keys of the host-scoped collections
+	// (containers and volumes of this node) to one lease of this agent,
+	// so they expire about that long after the agent dies, see Lease.
+	AgentLeaseTTL time.Duration
+
+	// CacheMaxStaleness gives every collection a read cache which is at
+	// most that old, see Proxy.EnableCache and KVStore.SetConsistency.
+	CacheMaxStaleness time.Duration
+
+	// LegacyListKeys keys recursive listings by the last key segment
+	// instead of the key relative to the collection, see
+	// Proxy.SetLegacyKeys.
+	LegacyListKeys bool
+
+	// Retry retries failed backend operations, see RetryPolicy
+	Retry *RetryPolicy
+
+	// SchemaEnvelope writes the collection values wrapped with their
+	// schema version (see RegisterMigration), which agents predating
+	// schemas decode as empty values. Turn it on once every agent reads
+	// envelopes, the values are written bare until then and Migrate
+	// refuses to run.
+	SchemaEnvelope bool
+
+	// Quarantine moves values the proxies can not decode to
+	// RootPath/_quarantine (see QuarantineKey) instead of leaving them
+	// for Sync to overwrite. Only List and Sync reading the backend
+	// quarantine, Plan, Watch and cached reads leave the values.
+	Quarantine bool
+
+	// SyncBatchSize makes Sync/Apply commit up to that many changes per
+	// transaction (one write per change when zero), see Txn.
+	SyncBatchSize int
+
+	// Logger defaults to the logrus standard logger
+	Logger log.FieldLogger
+	// NodeID and NodeName identify this host in the host-scoped paths of
+	// containers and volumes. NodeID (the swarm node ID) is preferred as
+	// it stays unique when hosts share a hostname, then NodeName, then
+	// $SHIPDOCK_NODE_NAME, then the hostname.
+	NodeID   string
+	NodeName string
+	// Codec encodes stored values, compact JSON for KVStore.Put and
+	// indented JSON for the collections when nil (?codec= in the url,
+	// see CodecByName). etcd takes the JSON codecs only.
+	Codec Codec
+	// Collections selects the collections to create, all when zero.
+	// Containers needs Networks to resolve network ids, so it is
+	// created along with Containers.
+	Collections Collection
+}
+
+// ParseOptions builds Options from a store url
+// (consul://host:8500/root, etcd://host1,host2/root?endpoint=host3,
+// zk://host1,host2/root, boltdb:///path/kv.db?bucket=b&root=r,
+// file:///path/dir?root=r, mem://name/root).
+func ParseOptions(storeUrl string) (*Options, error) {
+	uri, hosts, err := parseStoreURL(storeUrl)
+	if err != nil {
+		return nil, err
+	}
+	opts := &Options{
+		Endpoints: storeEndpoints(uri, hosts),
+		RootPath:  uri.Path,
+	}
+	credentialsFromURL(uri, opts)
+	switch scheme := strings.ToLower(uri.Scheme); scheme {
+	case "consul":
+		opts.Backend = store.CONSUL
+	case "etcd":
+		opts.Backend = store.ETCD
+	case "zk", "zookeeper":
+		opts.Backend = store.ZK
+	case "mem", "memory":
+		opts.Backend = MEMORY
+	case "file":
+		opts.Backend = FILE
+		if err := fileOptions(uri, opts); err != nil {
+			return nil, err
+		}
+	case "boltdb":
+		opts.Backend = store.BOLTDB
+		if err := boltdbOptions(uri, opts); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported uri schema: %+v (url:%s)", uri, storeUrl)
+	}
+	if opts.TLS, err = ParseTLSOptions(uri.Query()); err != nil {
+		return nil, err
+	}
+	if name := uri.Query().Get("codec"); len(name) > 0 {
+		if opts.Codec, err = CodecByName(name); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+func (o *Options) storeConfig() (*store.Config, error) {
+	config := &store.Config{
+		ConnectionTimeout: o.ConnectionTimeout,
+		Bucket:            o.Bucket,
+		PersistConnection: o.PersistConnection,
+	}
+	if o.Backend == store.BOLTDB && len(config.Bucket) == 0 {
+		config.Bucket = DEFAULT_BOLTDB_BUCKET
+	}
+	if config.ConnectionTimeout == 0 {
+		config.ConnectionTimeout = DEFAULT_CONNECTION_TIMEOUT
+	}
+	credentials, err := o.credentials()
+	if err != nil {
+		return nil, err
+	}
+	credentials.apply(config)
+	if o.TLS != nil {
+		if err := o.TLS.apply(config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func (o *Options) node() (string, error) {
+	node := o.NodeID
+	if len(node) == 0 {
+		node = o.NodeName
+	}
+	if len(node) == 0 {
+		node = os.Getenv(ENV_NODE_NAME)
+	}
+	if len(node) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		node = hostname
+	}
+	if err := validateNode(node); err != nil {
+		return "", err
+	}
+	return node, nil
+}
+
+// node identities are a single path segment
+func validateNode(node string) error {
+	if len(node) == 0 || node == "." || node == ".." || strings.Contains(node, "/") {
+		return fmt.Errorf("invalid node identity: %q", node)
+	}
+	return nil
+}
+
+func (o *Options) enabled(c Collection) bool {
+	return o.Collections == 0 || o.Collections&c != 0
+}
+
+// parseStoreURL parses a store url whose host part may list several
+// comma separated endpoints (zk://host1:2181,host2/root). url.Parse
+// rejects such a host, so the endpoints are cut out first and the url
+// is parsed with only the first one left in place.
+func parseStoreURL(storeUrl string) (*url.URL, []string, error) {
+	raw := storeUrl
+	hosts := make([]string, 0)
+	if i := strings.Index(raw, "://"); i >= 0 {
+		rest := raw[i+len("://"):]
+		end := strings.IndexAny(rest, "/?#")
+		if end < 0 {
+			end = len(rest)
+		}
+		userinfo := ""
+		authority := rest[:end]
+		if at := strings.LastIndex(authority, "@"); at >= 0 {
+			userinfo = authority[:at+1]
+			authority = authority[at+1:]
+		}
+		for _, host := range strings.Split(authority, ",") {
+			if host = strings.TrimSpace(host); len(host) > 0 {
+				hosts = append(hosts, host)
+			}
+		}
+		first := ""
+		if len(hosts) > 0 {
+			first = hosts[0]
+		}
+		raw = raw[:i+len("://")] + userinfo + first + rest[end:]
+	}
+	uri, err := url.Parse(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return uri, hosts, nil
+}
+
+// storeEndpoints returns the cluster members given as comma separated
+// hosts and as repeated endpoint= query parameters
+// (etcd://host1:2379,host2:2379/root?endpoint=host3:2379).
+func storeEndpoints(uri *url.URL, hosts []string) []string {
+	endpoints := make([]string, 0, len(hosts))
+	endpoints = append(endpoints, hosts...)
+	for _, value := range uri.Query()["endpoint"] {
+		for _, endpoint := range strings.Split(value, ",") {
+			if endpoint = strings.TrimSpace(endpoint); len(endpoint) > 0 {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	return endpoints
+}
@@ -0,0 +1,166 @@
+package kvstore
+
+import (
+	"github.com/shipdock/libkv/store"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseOptionsZookeeper(t *testing.T) {
+	for _, tc := range []struct {
+		url       string
+		endpoints []string
+		root      string
+	}{
+		{url: "zk://zk1:2181/shipdock", endpoints: []string{"zk1:2181"}, root: "/shipdock"},
+		{url: "zk://zk1:2181,zk2:2181,zk3/shipdock", endpoints: []string{"zk1:2181", "zk2:2181", "zk3"}, root: "/shipdock"},
+		{url: "zookeeper://zk1,zk2", endpoints: []string{"zk1", "zk2"}},
+		{url: "ZK://zk1/a/b", endpoints: []string{"zk1"}, root: "/a/b"},
+	} {
+		opts, err := ParseOptions(tc.url)
+		if err != nil {
+			t.Fatal(tc.url, err)
+		}
+		if opts.Backend != store.ZK || !reflect.DeepEqual(opts.Endpoints, tc.endpoints) || opts.RootPath != tc.root {
+			t.Fatal(tc.url, opts)
+		}
+	}
+}
+
+func TestParseStoreURL(t *testing.T) {
+	for _, tc := range []struct {
+		url       string
+		host      string
+		user      string
+		path      string
+		endpoints []string
+	}{
+		{url: "consul://host:8500/root", host: "host:8500", path: "/root", endpoints: []string{"host:8500"}},
+		{url: "etcd://h1:2379,h2:2379/root", host: "h1:2379", path: "/root", endpoints: []string{"h1:2379", "h2:2379"}},
+		{url: "etcd://h1, h2,/root?endpoint=h3&endpoint=h4,h5", host: "h1", path: "/root", endpoints: []string{"h1", "h2", "h3", "h4", "h5"}},
+		{url: "consul://u:p@h1,h2?x=1", host: "h1", user: "u", endpoints: []string{"h1", "h2"}},
+		{url: "mem:///root", path: "/root", endpoints: []string{}},
+		{url: "file:///dir?endpoint=", path: "/dir", endpoints: []string{}},
+	} {
+		uri, hosts, err := parseStoreURL(tc.url)
+		if err != nil {
+			t.Fatal(tc.url, err)
+		}
+		if uri.Host != tc.host || uri.Path != tc.path {
+			t.Fatal(tc.url, uri)
+		}
+		if user := uri.User.Username(); user != tc.user {
+			t.Fatal(tc.url, user)
+		}
+		if endpoints := storeEndpoints(uri, hosts); !reflect.DeepEqual(endpoints, tc.endpoints) {
+			t.Fatal(tc.url, endpoints)
+		}
+	}
+}
+
+func TestStoreConfigDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		opts    *Options
+		timeout time.Duration
+		bucket  string
+	}{
+		{opts: &Options{Backend: store.CONSUL}, timeout: DEFAULT_CONNECTION_TIMEOUT},
+		{opts: &Options{Backend: store.CONSUL, ConnectionTimeout: time.Second}, timeout: time.Second},
+		{opts: &Options{Backend: store.BOLTDB}, timeout: DEFAULT_CONNECTION_TIMEOUT, bucket: DEFAULT_BOLTDB_BUCKET},
+		{opts: &Options{Backend: store.BOLTDB, Bucket: "b"}, timeout: DEFAULT_CONNECTION_TIMEOUT, bucket: "b"},
+	} {
+		config, err := tc.opts.storeConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.ConnectionTimeout != tc.timeout || config.Bucket != tc.bucket || config.TLS != nil {
+			t.Fatal(tc.opts, config)
+		}
+	}
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	opts := &Options{Backend: MEMORY, Endpoints: []string{""}, NodeName: "n1"}
+	k, err := NewKVStoreWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if opts.Logger != nil || k.logger == nil {
+		t.Fatal(opts.Logger, k.logger)
+	}
+	if k.Services == nil || k.Networks == nil || k.Volumes == nil || k.Containers == nil || k.Nodes == nil {
+		t.Fatal(k)
+	}
+	for _, c := range []Collection{CollectionServices, CollectionNetworks, CollectionVolumes, CollectionContainers, CollectionNodes} {
+		if !opts.enabled(c) {
+			t.Fatal(c)
+		}
+	}
+}
+
+func TestOptionsCollections(t *testing.T) {
+	k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, NodeName: "n1", Collections: CollectionContainers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	// containers resolve network ids through Networks
+	if k.Containers == nil || k.Networks == nil || k.Services != nil || k.Volumes != nil || k.Nodes != nil {
+		t.Fatal(k)
+	}
+}
+
+func TestNode(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		opts  *Options
+		env   string
+		node  string
+		fails bool
+	}{
+		{opts: &Options{NodeID: "id1", NodeName: "n1"}, env: "e1", node: "id1"},
+		{opts: &Options{NodeName: "n1"}, env: "e1", node: "n1"},
+		{opts: &Options{}, env: "e1", node: "e1"},
+		{opts: &Options{}, node: hostname},
+		{opts: &Options{NodeID: "a/b"}, fails: true},
+		{opts: &Options{NodeName: ".."}, fails: true},
+		{opts: &Options{}, env: ".", fails: true},
+	} {
+		t.Setenv(ENV_NODE_NAME, tc.env)
+		node, err := tc.opts.node()
+		if tc.fails {
+			if err == nil {
+				t.Fatal(tc.opts, node)
+			}
+			continue
+		}
+		if err != nil || node != tc.node {
+			t.Fatal(tc.opts, node, err)
+		}
+	}
+}
+
+func TestGetNodeValidates(t *testing.T) {
+	k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, NodeID: "id1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if k.Node != "id1" {
+		t.Fatal(k.Node)
+	}
+	for _, node := range []string{"", ".", "..", "a/b", "../id1"} {
+		if _, err := k.Containers.ListNode(node); err == nil {
+			t.Fatal(node)
+		}
+		if _, err := k.Volumes.GetNode(node, "v"); err == nil {
+			t.Fatal(node)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package kvstore
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"sync"
+)
+
+// parallel calls fn(0..n-1) on up to workers goroutines and returns
+// once all calls are done. Callers write results into per-index slots
+// so the outcome does not depend on scheduling.
+func parallel(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// SetParallelism overrides the number of concurrent backend writes of
+// Sync/Apply and decoders of List for this proxy (1 is sequential).
+func (c *Proxy[T]) SetParallelism(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.parallelism = n
+}
+
+// SetRateLimit limits the backend writes of Sync/Apply to opsPerSecond,
+// zero removes the limit.
+func (c *Proxy[T]) SetRateLimit(opsPerSecond float64, burst int) {
+	limiter := newLimiter(opsPerSecond, burst)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limiter = limiter
+}
+
+// workers returns the parallelism and the rate limiter, which may
+// change while a Sync runs.
+func (c *Proxy[T]) workers() (int, *rate.Limiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.parallelism, c.limiter
+}
+
+func newLimiter(opsPerSecond float64, burst int) *rate.Limiter {
+	if opsPerSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(opsPerSecond), burst)
+}
+
+// each runs backend operations on the proxy's worker pool, each one
+// waiting for the rate limiter, and returns their errors by index. The
+// operations not started when ctx is done fail with its error.
+func (c *Proxy[T]) each(ctx context.Context, n int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	workers, limiter := c.workers()
+	parallel(n, workers, func(i int) {
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			return
+		}
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				errs[i] = err
+				return
+			}
+		}
+		errs[i] = fn(i)
+	})
+	return errs
+}
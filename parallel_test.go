@@ -0,0 +1,104 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"testing"
+	"time"
+)
+
+const BENCHMARK_SYNC_KEYS = 500
+
+const BENCHMARK_LATENCY = 200 * time.Microsecond
+
+// latencyStore delays every operation by BENCHMARK_LATENCY like a round
+// trip to a remote backend, a transaction counts as one round trip.
+type latencyStore struct {
+	store.Store
+}
+
+func (s *latencyStore) Get(key string) (*store.KVPair, error) {
+	time.Sleep(BENCHMARK_LATENCY)
+	return s.Store.Get(key)
+}
+
+func (s *latencyStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	time.Sleep(BENCHMARK_LATENCY)
+	return s.Store.List(directory, recursive)
+}
+
+func (s *latencyStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	time.Sleep(BENCHMARK_LATENCY)
+	return s.Store.Put(key, value, options)
+}
+
+func (s *latencyStore) Delete(key string) error {
+	time.Sleep(BENCHMARK_LATENCY)
+	return s.Store.Delete(key)
+}
+
+func (s *latencyStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	time.Sleep(BENCHMARK_LATENCY)
+	return s.Store.AtomicPut(key, value, previous, options)
+}
+
+func (s *latencyStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	time.Sleep(BENCHMARK_LATENCY)
+	return s.Store.AtomicDelete(key, previous)
+}
+
+func (s *latencyStore) commit(ctx context.Context, ops []*txnOp) ([]*store.KVPair, error) {
+	ts, ok := s.Store.(txnStore)
+	if !ok {
+		return nil, errTxnNotSupported
+	}
+	time.Sleep(BENCHMARK_LATENCY)
+	return ts.commit(ctx, ops)
+}
+
+// BenchmarkSync writes BENCHMARK_SYNC_KEYS new values and deletes them
+// again per iteration, one by one or batched, on one or more workers.
+func BenchmarkSync(b *testing.B) {
+	lvm := make(map[string]*Volume, BENCHMARK_SYNC_KEYS)
+	for i := 0; i < BENCHMARK_SYNC_KEYS; i++ {
+		name := fmt.Sprintf("v%d", i)
+		lvm[name] = &Volume{Name: name, Driver: "local"}
+	}
+	for _, bc := range []struct {
+		parallelism int
+		batchSize   int
+	}{
+		{1, 0},
+		{8, 0},
+		{1, 32},
+		{8, 32},
+	} {
+		b.Run(fmt.Sprintf("parallelism=%d/batch=%d", bc.parallelism, bc.batchSize), func(b *testing.B) {
+			k, err := NewKVStore("mem:///bench", "", "", "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer k.Close()
+			k.supervised.swap(&latencyStore{Store: k.supervised.current()})
+			p, err := NewCollectionProxy[Volume](k, nil, "volumes")
+			if err != nil {
+				b.Fatal(err)
+			}
+			p.SetParallelism(bc.parallelism)
+			if err := p.SetBatchSize(bc.batchSize); err != nil {
+				b.Fatal(err)
+			}
+			empty := make(map[string]*Volume)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.Sync(lvm); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := p.Sync(empty); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FieldDiff is one differing field of an updated value. Map entries are
+// reported one by one as Field[key].
+type FieldDiff struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// Change is one key a Plan creates, updates or deletes. Old is nil for
+// creates, New is nil for deletes.
+type Change[T any] struct {
+	Key    string
+	Old    *T
+	New    *T
+	Fields []FieldDiff
+	// the remote value the change was planned against
+	previous *store.KVPair
+}
+
+// Plan is what a Sync would do to the store. Apply executes it with
+// compare and swap against the values seen while planning, so a plan
+// reviewed against a store that changed since fails instead of
+// applying stale decisions.
+type Plan[T any] struct {
+	Create    []Change[T]
+	Update    []Change[T]
+	Delete    []Change[T]
+	Unchanged []string
+}
+
+func (p *Plan[T]) Empty() bool {
+	return len(p.Create) == 0 && len(p.Update) == 0 && len(p.Delete) == 0
+}
+
+func (p *Plan[T]) String() string {
+	var b strings.Builder
+	for _, c := range p.Create {
+		fmt.Fprintf(&b, "+ %s\n", c.Key)
+	}
+	for _, c := range p.Update {
+		fmt.Fprintf(&b, "~ %s\n", c.Key)
+		for _, f := range c.Fields {
+			fmt.Fprintf(&b, "    %s: %v -> %v\n", f.Field, f.Old, f.New)
+		}
+	}
+	for _, c := range p.Delete {
+		fmt.Fprintf(&b, "- %s\n", c.Key)
+	}
+	return b.String()
+}
+
+// Plan compares lvm with the values below the proxy root without
+// writing anything, values which fail to decode are neither reported
+// nor quarantined.
+func (c *Proxy[T]) Plan(lvm map[string]*T) (*Plan[T], error) {
+	return c.PlanContext(context.Background(), lvm)
+}
+
+func (c *Proxy[T]) PlanContext(ctx context.Context, lvm map[string]*T) (*Plan[T], error) {
+	return c.plan(ctx, lvm, false)
+}
+
+// plan is Plan, which reports and quarantines the values failing to
+// decode for Sync.
+func (c *Proxy[T]) plan(ctx context.Context, lvm map[string]*T, report bool) (*Plan[T], error) {
+	// build local/remote values
+	rvm, raw, _, err := c.list(ctx, true, report)
+	lease := c.currentLease()
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	plan := &Plan[T]{}
+	for lk, lv := range lvm {
+		rv, ok := rvm[lk]
+		if !ok {
+			// local exist, remote not-exist (put)
+			// raw holds values which failed to decode, overwrite them
+			plan.Create = append(plan.Create, Change[T]{Key: lk, New: lv, previous: raw[lk]})
+			continue
+		}
+		// local exist, remote exist (compare & put)
+		equal := false
+		if c.compare != nil {
+			equal = c.compare(lv, rv)
+		} else {
+			equal = reflect.DeepEqual(lv, rv)
+		}
+		if equal && lease != nil && !lease.holds(path.Join(c.rootPath, lk)) {
+			// written without the current lease (by an earlier run or
+			// before the lease expired), rewrite to tie it to the lease
+			equal = false
+		}
+		if equal {
+			plan.Unchanged = append(plan.Unchanged, lk)
+			continue
+		}
+		if kv, ok := raw[lk]; ok && c.schemaVersion(kv.Value) > schemaOf[T]().version {
+			// written by a newer agent, updating it would drop the
+			// fields this one does not know
+			c.logger.Debugf("PLAN:%s has a newer schema, leaving it", lk)
+			plan.Unchanged = append(plan.Unchanged, lk)
+			continue
+		}
+		plan.Update = append(plan.Update, Change[T]{
+			Key:      lk,
+			Old:      rv,
+			New:      lv,
+			Fields:   diffFields("", reflect.ValueOf(rv), reflect.ValueOf(lv)),
+			previous: raw[lk],
+		})
+	}
+	for rk, rv := range rvm {
+		if _, ok := lvm[rk]; !ok {
+			// local not-exist, remote exist (delete)
+			plan.Delete = append(plan.Delete, Change[T]{Key: rk, Old: rv, previous: raw[rk]})
+		}
+	}
+	sortChanges(plan.Create)
+	sortChanges(plan.Update)
+	sortChanges(plan.Delete)
+	sort.Strings(plan.Unchanged)
+	return plan, nil
+}
+
+// Apply executes a plan made by Plan on the proxy's worker pool, in
+// transactional batches when a batch size is set. A failing key does
+// not stop the others, the failures are returned together as a
+// *SyncError. Results and errors are in key order whatever the
+// parallelism.
+func (c *Proxy[T]) Apply(plan *Plan[T]) (*SyncResult, error) {
+	return c.ApplyContext(context.Background(), plan)
+}
+
+// ApplyContext is Apply which gives up when ctx is done, the changes
+// not written by then fail with its error.
+func (c *Proxy[T]) ApplyContext(ctx context.Context, plan *Plan[T]) (*SyncResult, error) {
+	result := &SyncResult{Unchanged: plan.Unchanged}
+	changes := make([]Change[T], 0, len(plan.Create)+len(plan.Update)+len(plan.Delete))
+	changes = append(changes, plan.Create...)
+	changes = append(changes, plan.Update...)
+	changes = append(changes, plan.Delete...)
+	lease := c.currentLease()
+	var failures []error
+	if size := c.currentBatchSize(); size > 0 {
+		failures = c.applyBatches(ctx, changes, size)
+	} else {
+		failures = c.each(ctx, len(changes), func(i int) error {
+			if changes[i].New == nil {
+				return c.atomicDelete(ctx, changes[i].Key, changes[i].previous)
+			}
+			return c.atomicPut(ctx, changes[i].Key, changes[i].New, changes[i].previous, lease)
+		})
+	}
+	errs := make([]*KeyError, 0)
+	for i, change := range changes {
+		switch {
+		case failures[i] != nil:
+			result.Failed = append(result.Failed, change.Key)
+			errs = append(errs, &KeyError{Key: change.Key, Err: failures[i]})
+		case i < len(plan.Create):
+			result.Created = append(result.Created, change.Key)
+		case i < len(plan.Create)+len(plan.Update):
+			result.Updated = append(result.Updated, change.Key)
+		default:
+			result.Deleted = append(result.Deleted, change.Key)
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool {
+			return errs[i].Key < errs[j].Key
+		})
+		sort.Strings(result.Failed)
+		return result, &SyncError{Errors: errs}
+	}
+	return result, nil
+}
+
+func sortChanges[T any](changes []Change[T]) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+}
+
+// diffFields walks exported struct fields and map entries down to the
+// values that differ.
+func diffFields(name string, a, b reflect.Value) []FieldDiff {
+	for a.IsValid() && a.Kind() == reflect.Ptr && b.IsValid() && b.Kind() == reflect.Ptr && !a.IsNil() && !b.IsNil() {
+		a, b = a.Elem(), b.Elem()
+	}
+	if !a.IsValid() || !b.IsValid() || a.Type() != b.Type() {
+		return leafDiff(name, a, b)
+	}
+	switch a.Kind() {
+	case reflect.Struct:
+		diffs := make([]FieldDiff, 0)
+		exported := false
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			exported = true
+			diffs = append(diffs, diffFields(joinField(name, field.Name), a.Field(i), b.Field(i))...)
+		}
+		if !exported {
+			// opaque values like time.Time
+			return leafDiff(name, a, b)
+		}
+		return diffs
+	case reflect.Map:
+		keys := make(map[string]reflect.Value)
+		for _, k := range a.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for _, k := range b.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		names := make([]string, 0, len(keys))
+		for k := range keys {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		diffs := make([]FieldDiff, 0)
+		for _, k := range names {
+			diffs = append(diffs, diffFields(fmt.Sprintf("%s[%s]", name, k), a.MapIndex(keys[k]), b.MapIndex(keys[k]))...)
+		}
+		return diffs
+	}
+	return leafDiff(name, a, b)
+}
+
+func leafDiff(name string, a, b reflect.Value) []FieldDiff {
+	var av, bv interface{}
+	if a.IsValid() {
+		av = a.Interface()
+	}
+	if b.IsValid() {
+		bv = b.Interface()
+	}
+	if reflect.DeepEqual(av, bv) {
+		return nil
+	}
+	return []FieldDiff{{Field: name, Old: av, New: bv}}
+}
+
+func joinField(name, field string) string {
+	if len(name) == 0 {
+		return field
+	}
+	return name + "." + field
+}
@@ -0,0 +1,41 @@
+package kvstore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	k, err := NewKVStore("mem:///r", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p, err := NewCollectionProxy[Volume](k, nil, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put("a", &Volume{Name: "a", Labels: map[string]string{"k": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put("d", &Volume{Name: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := p.Plan(map[string]*Volume{"a": {Name: "a", Labels: map[string]string{"k": "2", "n": "x"}}, "b": {Name: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := plan.String()
+	for _, want := range []string{"Labels[k]: 1 -> 2", "+ b", "- d"} {
+		if !strings.Contains(s, want) {
+			t.Fatal(want, s)
+		}
+	}
+	if _, err := p.Apply(plan); err != nil {
+		t.Fatal(err)
+	}
+	l, err := p.List(true)
+	if err != nil || len(l) != 2 {
+		t.Fatal(l, err)
+	}
+}
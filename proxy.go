@@ -1,123 +1,280 @@
 package kvstore
 
 import (
-	"encoding/json"
+	"context"
 	"github.com/shipdock/libkv/store"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 	"path"
-	"reflect"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 )
 
-type Unmarshaller func(v []byte) (interface{}, error)
-type Comparator func(a, b interface{}) bool
+type Comparator[T any] func(a, b *T) bool
 
-type Proxy struct {
-	kvstore   store.Store
-	rootPath  string
-	unmarshal Unmarshaller
-	compare   Comparator
+// Proxy stores values of type T as encoded values below rootPath.
+type Proxy[T any] struct {
+	parent   *KVStore
+	kvstore  store.Store
+	rootPath string
+	compare  Comparator[T]
+	codec    Codec
+	logger   log.FieldLogger
+	mu       sync.Mutex
+	indexes  map[string]uint64
+	// worker pool and rate limit of Sync/Apply, see parallel.go
+	parallelism int
+	limiter     *rate.Limiter
+	batchSize   int
+	lease       *Lease
+	retry       *RetryPolicy
+	// guarded by mu, see cache.go
+	cache *proxyCache
+	// key recursive listings by the last segment only, see SetLegacyKeys
+	legacyKeys bool
+	// wrap values with their schema version, see Options.SchemaEnvelope
+	envelope bool
 }
 
-func NewProxy(kvstore *KVStore, rootPath string, unmarshaller Unmarshaller, comparator Comparator) (*Proxy, error) {
-	c := &Proxy{
-		kvstore:   kvstore.Store,
-		rootPath:  rootPath,
-		unmarshal: unmarshaller,
-		compare:   comparator,
+func NewProxy[T any](kvstore *KVStore, rootPath string, comparator Comparator[T]) (*Proxy[T], error) {
+	c := &Proxy[T]{
+		parent:      kvstore,
+		kvstore:     kvstore.Store,
+		rootPath:    rootPath,
+		compare:     comparator,
+		codec:       kvstore.codec,
+		logger:      kvstore.Logger(),
+		indexes:     make(map[string]uint64),
+		parallelism: kvstore.syncParallelism,
+		limiter:     kvstore.syncLimiter,
+		batchSize:   kvstore.syncBatchSize,
+		legacyKeys:  kvstore.opts != nil && kvstore.opts.LegacyListKeys,
+		envelope:    kvstore.opts != nil && kvstore.opts.SchemaEnvelope,
+	}
+	if c.codec == nil {
+		c.codec = IndentJSONCodec
 	}
 	return c, nil
 }
 
-func (c *Proxy) Put(key string, value interface{}) error {
-	bv, err := json.MarshalIndent(value, "", "  ")
+// NewCollectionProxy returns a proxy for RootPath/segments..., which is
+// all a new resource type needs besides its struct.
+func NewCollectionProxy[T any](kvstore *KVStore, comparator Comparator[T], segments ...string) (*Proxy[T], error) {
+	rootPath := TrimRelative(filepath.Clean(path.Join(append([]string{kvstore.RootPath}, segments...)...)))
+	return NewProxy(kvstore, rootPath, comparator)
+}
+
+func (c *Proxy[T]) Put(key string, value *T) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+// PutContext is Put which gives up when ctx is done, as do the other
+// *Context methods. A write given up on may still be applied.
+func (c *Proxy[T]) PutContext(ctx context.Context, key string, value *T) error {
+	if lease := c.currentLease(); lease != nil {
+		return c.putWithLease(ctx, key, value, lease)
+	}
+	bv, err := c.encode(value)
 	if err != nil {
 		return err
 	}
 	target := path.Join(c.rootPath, key)
-	log.Debugf("PUT:%s", target)
-	if err := c.kvstore.Put(target, bv, &store.WriteOptions{IsDir: false}); err != nil {
-		return err
-	}
-	return nil
+	c.logger.Debugf("PUT:%s", target)
+	defer c.invalidateCache()
+	err = c.do(ctx, func() error {
+		return withContext(ctx, c.kvstore).Put(target, bv, &store.WriteOptions{IsDir: false})
+	})
+	// a failed write may have been applied as well
+	c.forget(key)
+	return err
+}
+
+func (c *Proxy[T]) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
 }
 
-func (c *Proxy) Delete(key string) error {
+func (c *Proxy[T]) DeleteContext(ctx context.Context, key string) error {
 	target := path.Join(c.rootPath, key)
-	log.Debugf("DELETE:%s", target)
-	return c.kvstore.Delete(target)
+	c.logger.Debugf("DELETE:%s", target)
+	c.forget(key)
+	defer c.invalidateCache()
+	if lease := c.currentLease(); lease != nil {
+		lease.unbind(target)
+	}
+	return c.do(ctx, func() error {
+		return withContext(ctx, c.kvstore).Delete(target)
+	})
 }
 
-func (c *Proxy) Get(key string) (interface{}, error) {
-	kv, err := c.kvstore.Get(path.Join(c.rootPath, key))
-	if err != nil {
-		return nil, err
+func (c *Proxy[T]) Get(key string) (*T, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+func (c *Proxy[T]) GetContext(ctx context.Context, key string) (*T, error) {
+	var kv *store.KVPair
+	if kvs, ok := c.cached(ctx); ok {
+		if kv = kvs[key]; kv == nil {
+			return nil, store.ErrKeyNotFound
+		}
+	} else {
+		err := c.do(ctx, func() (err error) {
+			kv, err = withContext(ctx, c.kvstore).Get(path.Join(c.rootPath, key))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
-	rv, err := c.unmarshal(kv.Value)
+	v, err := c.decode(kv.Value)
 	if err != nil {
 		return nil, err
 	}
-	return rv, nil
+	c.remember(key, kv.LastIndex)
+	return v, nil
+}
+
+func (c *Proxy[T]) List(recursive bool) (map[string]*T, error) {
+	return c.ListContext(context.Background(), recursive)
+}
+
+func (c *Proxy[T]) ListContext(ctx context.Context, recursive bool) (map[string]*T, error) {
+	rl, _, err := c.ListWithFailuresContext(ctx, recursive)
+	return rl, err
+}
+
+// ListWithFailures is List which also returns the values that could
+// not be decoded, in key order.
+func (c *Proxy[T]) ListWithFailures(recursive bool) (map[string]*T, []*DecodeFailure, error) {
+	return c.ListWithFailuresContext(context.Background(), recursive)
+}
+
+func (c *Proxy[T]) ListWithFailuresContext(ctx context.Context, recursive bool) (map[string]*T, []*DecodeFailure, error) {
+	if kvs, ok := c.cachedList(ctx, recursive); ok {
+		// cached reads neither report nor quarantine, Sync does
+		rl, failures := c.decodeAll(kvs)
+		return rl, failures, nil
+	}
+	rl, _, failures, err := c.list(ctx, recursive, true)
+	return rl, failures, err
 }
 
-func (c *Proxy) List(recursive bool) (map[string]interface{}, error) {
-	kvs, err := c.kvstore.List(path.Join(c.rootPath), recursive)
+// relative returns a backend key relative to the proxy root.
+func (c *Proxy[T]) relative(key string) string {
+	return strings.TrimPrefix(strings.Trim(key, "/"), strings.Trim(c.rootPath, "/")+"/")
+}
+
+// SetLegacyKeys keys the results of recursive listings and watches by
+// the last segment of the key (web-1234abcd) instead of the key relative
+// to the proxy root (host-a/web-1234abcd), like before. Values with the
+// same name in different subdirectories then overwrite each other.
+func (c *Proxy[T]) SetLegacyKeys(legacy bool) {
+	c.mu.Lock()
+	c.legacyKeys = legacy
+	c.mu.Unlock()
+	c.invalidateCache()
+}
+
+// listKey returns the key of a backend key in listings. The indexes
+// are kept by relative key in either mode.
+func (c *Proxy[T]) listKey(key string) string {
+	c.mu.Lock()
+	legacy := c.legacyKeys
+	c.mu.Unlock()
+	if legacy {
+		return path.Base(key)
+	}
+	return c.relative(key)
+}
+
+// list also returns the raw pairs by key, including the values which
+// failed to decode and were not quarantined. Only explicit List and Sync
+// calls report, and quarantine, the failures.
+func (c *Proxy[T]) list(ctx context.Context, recursive bool, report bool) (map[string]*T, map[string]*store.KVPair, []*DecodeFailure, error) {
+	var kvs []*store.KVPair
+	err := c.do(ctx, func() (err error) {
+		kvs, err = withContext(ctx, c.kvstore).List(path.Join(c.rootPath), recursive)
+		return err
+	})
 	if err != nil {
 		if err == store.ErrKeyNotFound {
-			return make(map[string]interface{}), nil
+			c.prune(nil, recursive)
+			return make(map[string]*T), make(map[string]*store.KVPair), nil, nil
 		}
-		return nil, err
+		return nil, nil, nil, err
 	}
-	rl := make(map[string]interface{})
+	raw := make(map[string]*store.KVPair)
+	listed := make(map[string]bool)
 	for _, kv := range kvs {
-		if len(kv.Value) == 0 {
-			continue
+		if len(kv.Value) > 0 {
+			raw[c.listKey(kv.Key)] = kv
+			listed[c.relative(kv.Key)] = true
 		}
-		v, err := c.unmarshal(kv.Value)
-		// do not return unmarshal error
-		// interface's struct can be changed and sometimes it can be fail
-		// just ignore unmarshal error (treat not exist) to overwrite interface struct
-		if err != nil {
-			continue
+	}
+	c.prune(listed, recursive)
+	rl, failures := c.decodeAll(kvs)
+	if report {
+		c.failed(failures)
+	}
+	for _, failure := range failures {
+		if failure.Quarantined {
+			delete(raw, failure.Key)
 		}
-		rl[path.Base(kv.Key)] = v
 	}
-	return rl, nil
+	return rl, raw, failures, nil
 }
 
-func (c *Proxy) Sync(lvm map[string]interface{}) error {
-	// build local/remote values
-	rvm, err := c.List(true)
-	if err != nil && err != store.ErrKeyNotFound {
-		return err
-	}
-	// compare & update
-	for lk, lv := range lvm {
-		rv, ok := rvm[lk]
-		if ok {
-			// local exist, remote exist (compare & put)
-			if c.compare != nil {
-				if !c.compare(lv, rv) {
-					c.Put(lk, lv)
-				}
-
-			} else if !reflect.DeepEqual(lv, rv) {
-				c.Put(lk, lv)
-			}
-		} else {
-			// local exist, remote not-exist (put)
-			if err := c.Put(lk, lv); err != nil {
-				return err
-			}
+// decodeAll decodes on the proxy's worker pool, which pays off for the
+// large recursive listings of busy clusters. Values which fail to
+// decode are left out and reported, see OnDecodeFailure.
+func (c *Proxy[T]) decodeAll(kvs []*store.KVPair) (map[string]*T, []*DecodeFailure) {
+	values := make([]*T, len(kvs))
+	errs := make([]error, len(kvs))
+	workers, _ := c.workers()
+	parallel(len(kvs), workers, func(i int) {
+		if len(kvs[i].Value) == 0 {
+			return
 		}
-	}
-	for rk, _ := range rvm {
-		_, ok := lvm[rk]
-		if !ok {
-			// local not-exist, remote exist (delete)
-			if err := c.Delete(rk); err != nil {
-				return err
-			}
+		values[i], errs[i] = c.decode(kvs[i].Value)
+	})
+	rl := make(map[string]*T)
+	failures := make([]*DecodeFailure, 0)
+	for i, kv := range kvs {
+		if errs[i] != nil {
+			failures = append(failures, &DecodeFailure{
+				Key:      c.listKey(kv.Key),
+				StoreKey: kv.Key,
+				Value:    kv.Value,
+				Err:      errs[i],
+				index:    kv.LastIndex,
+			})
+			continue
 		}
+		if values[i] == nil {
+			continue
+		}
+		rl[c.listKey(kv.Key)] = values[i]
+		c.remember(c.relative(kv.Key), kv.LastIndex)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].StoreKey < failures[j].StoreKey
+	})
+	return rl, failures
+}
+
+// Sync makes the values below the proxy root equal to lvm, it is Plan
+// followed by Apply. Writes are compare and swap against the values
+// just listed, so a concurrent Sync from another manager fails with
+// store.ErrKeyModified instead of being silently overwritten.
+func (c *Proxy[T]) Sync(lvm map[string]*T) (*SyncResult, error) {
+	return c.SyncContext(context.Background(), lvm)
+}
+
+func (c *Proxy[T]) SyncContext(ctx context.Context, lvm map[string]*T) (*SyncResult, error) {
+	plan, err := c.plan(ctx, lvm, true)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return c.ApplyContext(ctx, plan)
 }
@@ -0,0 +1,82 @@
+package kvstore
+
+import (
+	"github.com/shipdock/libkv/store"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	k, err := NewKVStore("mem:///root", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p, err := NewCollectionProxy[Volume](k, nil, "things")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get("a"); err != store.ErrKeyNotFound {
+		t.Fatal(err)
+	}
+	if l, err := p.List(true); err != nil || len(l) != 0 {
+		t.Fatal(l, err)
+	}
+	if err := p.Put("a", &Volume{Name: "a", Driver: "local"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put("h1/b", &Volume{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := p.Get("a")
+	if err != nil || v.Name != "a" || v.Driver != "local" {
+		t.Fatal(v, err)
+	}
+	if l, err := p.List(false); err != nil || len(l) != 1 || l["a"] == nil {
+		t.Fatal(l, err)
+	}
+	if l, err := p.List(true); err != nil || len(l) != 2 || l["h1/b"] == nil {
+		t.Fatal(l, err)
+	}
+	if err := p.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get("a"); err != store.ErrKeyNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestProxySync(t *testing.T) {
+	k, err := NewKVStore("mem:///root", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p, err := NewCollectionProxy[Volume](k, nil, "things")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put("h1/b", &Volume{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		lvm                                  map[string]*Volume
+		created, updated, deleted, unchanged int
+	}{
+		{map[string]*Volume{"c": {Name: "c"}, "h1/b": {Name: "b", Driver: "nfs"}}, 1, 1, 0, 0},
+		{map[string]*Volume{"c": {Name: "c"}}, 0, 0, 1, 1},
+		{map[string]*Volume{"c": {Name: "c"}}, 0, 0, 0, 1},
+		{nil, 0, 0, 1, 0},
+	} {
+		r, err := p.Sync(tc.lvm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Created) != tc.created || len(r.Updated) != tc.updated || len(r.Deleted) != tc.deleted || len(r.Unchanged) != tc.unchanged {
+			t.Fatal(r)
+		}
+		l, err := p.List(true)
+		if err != nil || len(l) != len(tc.lvm) {
+			t.Fatal(l, err)
+		}
+	}
+}
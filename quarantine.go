@@ -0,0 +1,110 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"path"
+	"strings"
+	"time"
+)
+
+// QUARANTINE_PATH is where undecodable values are moved, below RootPath
+// and under their path relative to RootPath.
+const QUARANTINE_PATH = "_quarantine"
+
+// DecodeFailure is a stored value which could not be decoded. Lists
+// leave it out of their results, Sync treats its key as missing and
+// overwrites it unless it was quarantined.
+type DecodeFailure struct {
+	// Key is the key in the proxy's results, StoreKey the backend key
+	Key         string
+	StoreKey    string
+	Value       []byte
+	Err         error
+	Quarantined bool
+	index       uint64
+}
+
+func (f *DecodeFailure) Error() string {
+	return fmt.Sprintf("%s: %v", f.StoreKey, f.Err)
+}
+
+func (f *DecodeFailure) Unwrap() error {
+	return f.Err
+}
+
+type DecodeFailureFunc func(failure *DecodeFailure)
+
+// Quarantined is the record a quarantined value is kept in, always as
+// JSON so that it can be read with any tool. Value holds the original
+// bytes for repair.
+type Quarantined struct {
+	Key   string
+	Error string
+	Time  time.Time
+	Value []byte
+}
+
+// OnDecodeFailure registers fn to be called for every value the proxies
+// of this KVStore fail to decode while listing the backend in List or
+// Sync, after the value was quarantined if Options.Quarantine is set,
+// and once per value while watching. Plan and cached reads do not
+// report.
+func (k *KVStore) OnDecodeFailure(fn DecodeFailureFunc) {
+	k.stateMu.Lock()
+	defer k.stateMu.Unlock()
+	k.decodeFuncs = append(k.decodeFuncs, fn)
+}
+
+func (k *KVStore) decodeFailed(failure *DecodeFailure) {
+	k.stateMu.Lock()
+	funcs := append([]DecodeFailureFunc(nil), k.decodeFuncs...)
+	k.stateMu.Unlock()
+	k.Logger().Warnf("kvstore can not decode %s: %v", failure.StoreKey, failure.Err)
+	for _, fn := range funcs {
+		fn(failure)
+	}
+}
+
+// QuarantineKey returns where the value of key is moved to when it
+// can not be decoded.
+func (k *KVStore) QuarantineKey(key string) string {
+	root := strings.Trim(k.RootPath, "/")
+	rel := strings.TrimPrefix(strings.Trim(key, "/"), root+"/")
+	return path.Join(k.RootPath, QUARANTINE_PATH, rel)
+}
+
+// quarantine moves the value of failure away in one transaction, the
+// delete is compare and swap so a value rewritten meanwhile stays.
+func (c *Proxy[T]) quarantine(failure *DecodeFailure) error {
+	target := c.parent.QuarantineKey(failure.StoreKey)
+	bv, err := json.Marshal(&Quarantined{
+		Key:   failure.StoreKey,
+		Error: failure.Err.Error(),
+		Time:  time.Now().UTC(),
+		Value: failure.Value,
+	})
+	if err != nil {
+		return err
+	}
+	c.logger.Infof("QUARANTINE:%s to %s", failure.StoreKey, target)
+	txn := newTxn(c.kvstore, c.codec, c.logger)
+	txn.add(&txnOp{verb: txnPut, key: target, value: bv})
+	txn.add(&txnOp{verb: txnDelete, key: failure.StoreKey, cas: true, previous: &store.KVPair{Key: failure.StoreKey, LastIndex: failure.index}})
+	return txn.Commit()
+}
+
+// failed quarantines and reports the values decodeAll could not decode.
+func (c *Proxy[T]) failed(failures []*DecodeFailure) {
+	for _, failure := range failures {
+		if c.parent.opts != nil && c.parent.opts.Quarantine {
+			if err := c.quarantine(failure); err != nil {
+				c.logger.Warnf("QUARANTINE:%s failed: %v", failure.StoreKey, err)
+			} else {
+				failure.Quarantined = true
+			}
+		}
+		c.parent.decodeFailed(failure)
+	}
+}
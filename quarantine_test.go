@@ -0,0 +1,68 @@
+package kvstore
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	for _, tc := range []struct {
+		quarantine bool
+		op         string
+		reported   int
+		moved      bool
+	}{
+		{true, "list", 1, true},
+		{false, "list", 1, false},
+		// Plan neither reports nor quarantines
+		{true, "plan", 0, false},
+		{true, "sync", 1, true},
+		{false, "sync", 1, false},
+	} {
+		k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, RootPath: "root", Collections: CollectionNodes | CollectionContainers, Quarantine: tc.quarantine, NodeName: "h1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		seen := make([]*DecodeFailure, 0)
+		k.OnDecodeFailure(func(f *DecodeFailure) {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, f)
+		})
+		if err := k.Store.Put("root/containers/h1/bad", []byte("{garbage"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := k.Store.Put("root/containers/h1/good", []byte(`{"Name":"good"}`), nil); err != nil {
+			t.Fatal(err)
+		}
+		p := k.Containers.proxy
+		switch tc.op {
+		case "list":
+			m, fails, err := k.Containers.ListAllWithFailures()
+			if err != nil || len(m) != 1 || len(fails) != 1 || fails[0].Quarantined != tc.quarantine {
+				t.Fatal(tc, m, fails, err)
+			}
+		case "plan":
+			if _, err := p.Plan(map[string]*Container{"good": {Name: "good"}}); err != nil {
+				t.Fatal(err)
+			}
+		case "sync":
+			if _, err := p.Sync(map[string]*Container{"good": {Name: "good"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mu.Lock()
+		if len(seen) != tc.reported || (len(seen) > 0 && seen[0].StoreKey != "root/containers/h1/bad") {
+			t.Fatal(tc, seen)
+		}
+		mu.Unlock()
+		if ok, err := k.Store.Exists("root/containers/h1/bad"); err != nil || ok == tc.moved {
+			t.Fatal(tc, "left in place:", ok, err)
+		}
+		if ok, err := k.Store.Exists(k.QuarantineKey("root/containers/h1/bad")); err != nil || ok != tc.moved {
+			t.Fatal(tc, "quarantined:", ok, err)
+		}
+		k.Close()
+	}
+}
@@ -0,0 +1,55 @@
+package kvstore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SyncResult lists the keys a Sync or Apply touched, in key order.
+type SyncResult struct {
+	Created   []string
+	Updated   []string
+	Deleted   []string
+	Unchanged []string
+	Failed    []string
+}
+
+func (r *SyncResult) String() string {
+	return fmt.Sprintf("created:%d updated:%d deleted:%d unchanged:%d failed:%d",
+		len(r.Created), len(r.Updated), len(r.Deleted), len(r.Unchanged), len(r.Failed))
+}
+
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// SyncError collects the per-key failures of a Sync. The other keys
+// were still synced, see SyncResult.
+type SyncError struct {
+	Errors []*KeyError
+}
+
+func (e *SyncError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("sync failed for %d key(s): %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *SyncError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
@@ -0,0 +1,167 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"math/rand"
+	"time"
+)
+
+const (
+	DEFAULT_RETRY_INITIAL_INTERVAL = 100 * time.Millisecond
+	DEFAULT_RETRY_MAX_INTERVAL     = 5 * time.Second
+	DEFAULT_RETRY_MULTIPLIER       = 2.0
+	DEFAULT_RETRY_MAX_ELAPSED_TIME = 30 * time.Second
+)
+
+// RetryPolicy retries failed backend operations with exponential
+// backoff. Zero fields take the DEFAULT_RETRY_* values, a negative
+// MaxElapsedTime and a zero MaxAttempts do not limit the retries.
+//
+// A policy of a KVStore (Options.Retry, KVStore.SetRetryPolicy) applies
+// to its Put and Remove and to all proxies, a policy of a collection
+// overrides it for that collection. It covers every backend call of
+// Get, List, Put, Delete and Sync/Apply, where a retried compare and
+// swap write may fail with store.ErrKeyModified when the first try was
+// applied after all. Without a policy operations are tried once.
+type RetryPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter spreads each interval randomly by up to that fraction of
+	// it, 0.2 waits between 80% and 120% of the interval.
+	Jitter         float64
+	MaxElapsedTime time.Duration
+	// MaxAttempts counts the first try as well
+	MaxAttempts int
+	// Retryable tells the errors worth another try, IsRetryable when nil
+	Retryable func(err error) bool
+}
+
+// defaultServiceWait is how long Services.Get waits for a service which
+// is not written yet, MAX_RETRY_COUNT retries RETRY_TERM apart as before
+// retry policies.
+var defaultServiceWait = &RetryPolicy{
+	InitialInterval: RETRY_TERM,
+	MaxInterval:     RETRY_TERM,
+	Multiplier:      1,
+	MaxElapsedTime:  -1,
+	MaxAttempts:     MAX_RETRY_COUNT + 1,
+}
+
+// IsRetryable reports the errors of unreachable backends (including
+// network timeouts), which another try may not get.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return errors.Is(err, store.ErrNotReachable) || isUnreachable(err)
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// interval returns the wait after the given failed attempt, before
+// jitter.
+func (p *RetryPolicy) interval(attempt int) time.Duration {
+	interval, max, multiplier := p.InitialInterval, p.MaxInterval, p.Multiplier
+	if interval <= 0 {
+		interval = DEFAULT_RETRY_INITIAL_INTERVAL
+	}
+	if max <= 0 {
+		max = DEFAULT_RETRY_MAX_INTERVAL
+	}
+	if multiplier <= 0 {
+		multiplier = DEFAULT_RETRY_MULTIPLIER
+	}
+	wait := float64(interval)
+	for i := 1; i < attempt && wait < float64(max); i++ {
+		wait *= multiplier
+	}
+	if wait > float64(max) {
+		wait = float64(max)
+	}
+	if p.Jitter > 0 {
+		wait += wait * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(wait)
+}
+
+// Do calls fn until it succeeds, fails with an error which is not
+// retryable or the policy gives up, and returns the last error. When
+// ctx is done while waiting, the error wraps ctx.Err() and the last
+// error. A nil policy calls fn once.
+func (p *RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	err := fn()
+	if p == nil {
+		return err
+	}
+	elapsed := p.MaxElapsedTime
+	if elapsed == 0 {
+		elapsed = DEFAULT_RETRY_MAX_ELAPSED_TIME
+	}
+	start := time.Now()
+	for attempt := 1; err != nil && p.retryable(err); attempt++ {
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			break
+		}
+		wait := p.interval(attempt)
+		if elapsed > 0 && time.Since(start)+wait > elapsed {
+			break
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-timer.C:
+		}
+		err = fn()
+	}
+	return err
+}
+
+// SetRetryPolicy sets the policy of KVStore.Put and Remove and of the
+// proxies without a policy of their own, nil tries once.
+func (k *KVStore) SetRetryPolicy(policy *RetryPolicy) {
+	k.stateMu.Lock()
+	defer k.stateMu.Unlock()
+	k.retry = policy
+}
+
+func (k *KVStore) retryPolicy() *RetryPolicy {
+	k.stateMu.Lock()
+	defer k.stateMu.Unlock()
+	return k.retry
+}
+
+// SetRetryPolicy overrides the policy of the KVStore for this proxy,
+// nil follows the KVStore again. A policy with MaxAttempts 1 tries once.
+func (c *Proxy[T]) SetRetryPolicy(policy *RetryPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retry = policy
+}
+
+// retryPolicy returns the policy of the proxy, the one of the KVStore
+// at the time of the call without one.
+func (c *Proxy[T]) retryPolicy() *RetryPolicy {
+	c.mu.Lock()
+	policy := c.retry
+	c.mu.Unlock()
+	if policy != nil {
+		return policy
+	}
+	return c.parent.retryPolicy()
+}
+
+// do runs fn under the retry policy of the proxy.
+func (c *Proxy[T]) do(ctx context.Context, fn func() error) error {
+	return c.retryPolicy().Do(ctx, fn)
+}
@@ -0,0 +1,139 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"github.com/shipdock/libkv/store"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyStore fails the next fails writes as unreachable and reports the
+// next missing reads as not found.
+type flakyStore struct {
+	store.Store
+	fails   int32
+	missing int32
+}
+
+func (s *flakyStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	if atomic.AddInt32(&s.fails, -1) >= 0 {
+		return store.ErrNotReachable
+	}
+	return s.Store.Put(key, value, options)
+}
+
+func (s *flakyStore) Get(key string) (*store.KVPair, error) {
+	if atomic.AddInt32(&s.missing, -1) >= 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return s.Store.Get(key)
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	last := errors.New("last")
+	for _, tc := range []struct {
+		name   string
+		policy *RetryPolicy
+		errs   []error
+		calls  int
+		err    error
+	}{
+		{"nil policy tries once", nil, []error{store.ErrNotReachable}, 1, store.ErrNotReachable},
+		{"success", &RetryPolicy{InitialInterval: time.Millisecond}, []error{nil}, 1, nil},
+		{"not retryable", &RetryPolicy{InitialInterval: time.Millisecond}, []error{store.ErrKeyNotFound}, 1, store.ErrKeyNotFound},
+		{"until a final error", &RetryPolicy{InitialInterval: time.Millisecond, MaxAttempts: 4, Jitter: 0.5}, []error{store.ErrNotReachable, store.ErrNotReachable, last}, 3, last},
+		{"max attempts", &RetryPolicy{InitialInterval: time.Millisecond, MaxAttempts: 2}, []error{store.ErrNotReachable, store.ErrNotReachable, nil}, 2, store.ErrNotReachable},
+		{"max elapsed time", &RetryPolicy{InitialInterval: time.Hour, MaxInterval: time.Hour, MaxElapsedTime: time.Minute}, []error{store.ErrNotReachable, nil}, 1, store.ErrNotReachable},
+		{"own retryable", &RetryPolicy{InitialInterval: time.Millisecond, Retryable: func(err error) bool { return err == last }}, []error{last, nil}, 2, nil},
+	} {
+		calls := 0
+		err := tc.policy.Do(context.Background(), func() error {
+			err := tc.errs[calls]
+			calls++
+			return err
+		})
+		if calls != tc.calls || err != tc.err {
+			t.Fatal(tc.name, calls, err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := (&RetryPolicy{InitialInterval: time.Hour}).Do(ctx, func() error { return store.ErrNotReachable })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryPolicyInterval(t *testing.T) {
+	p := &RetryPolicy{InitialInterval: time.Second, MaxInterval: 5 * time.Second, Multiplier: 2}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := p.interval(attempt + 1); got != want {
+			t.Fatal(attempt+1, got, want)
+		}
+	}
+}
+
+func TestCollectionRetryPolicy(t *testing.T) {
+	fast := &RetryPolicy{InitialInterval: time.Millisecond, MaxAttempts: 3}
+	k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, RootPath: "root", NodeName: "h1", Collections: CollectionNetworks, Retry: fast})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	s := &flakyStore{Store: k.Networks.proxy.kvstore}
+	k.Networks.proxy.kvstore = s
+	for _, tc := range []struct {
+		name       string
+		kvstore    *RetryPolicy
+		collection *RetryPolicy
+		fails      int32
+		err        error
+	}{
+		{"the KVStore policy", fast, nil, 2, nil},
+		{"the collection policy wins", fast, &RetryPolicy{MaxAttempts: 1}, 1, store.ErrNotReachable},
+		{"a later KVStore policy applies", &RetryPolicy{InitialInterval: time.Millisecond, MaxAttempts: 1}, nil, 1, store.ErrNotReachable},
+		{"no policy at all", nil, nil, 1, store.ErrNotReachable},
+	} {
+		k.SetRetryPolicy(tc.kvstore)
+		k.Networks.SetRetryPolicy(tc.collection)
+		atomic.StoreInt32(&s.fails, tc.fails)
+		if err := k.Networks.proxy.Put("n", &Network{Name: "n"}); err != tc.err {
+			t.Fatal(tc.name, err)
+		}
+	}
+}
+
+func TestServicesWaitPolicy(t *testing.T) {
+	k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, RootPath: "root", NodeName: "h1", Collections: CollectionServices})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if err := k.Services.proxy.Put("s", &Service{Name: "s", ID: "id"}); err != nil {
+		t.Fatal(err)
+	}
+	s := &flakyStore{Store: k.Services.proxy.kvstore}
+	k.Services.proxy.kvstore = s
+	for _, tc := range []struct {
+		name    string
+		policy  *RetryPolicy
+		missing int32
+		err     error
+	}{
+		{"written while waiting", &RetryPolicy{InitialInterval: time.Millisecond, Multiplier: 1, MaxAttempts: 5}, 3, nil},
+		{"gives up", &RetryPolicy{InitialInterval: time.Millisecond, MaxAttempts: 3}, 3, store.ErrKeyNotFound},
+		{"nil does not wait", nil, 1, store.ErrKeyNotFound},
+	} {
+		k.Services.SetWaitPolicy(tc.policy)
+		atomic.StoreInt32(&s.missing, tc.missing)
+		if _, err := k.Services.Get("s", "id"); err != tc.err {
+			t.Fatal(tc.name, err)
+		}
+	}
+	// the default waits MAX_RETRY_COUNT retries RETRY_TERM apart
+	if defaultServiceWait.MaxAttempts != MAX_RETRY_COUNT+1 || defaultServiceWait.interval(3) != RETRY_TERM {
+		t.Fatal(defaultServiceWait)
+	}
+}
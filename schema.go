@@ -0,0 +1,137 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Migration upgrades a record by one schema version. It works on the
+// generic form of the record (field name to value, as decoded from
+// JSON) so old layouts do not need their own structs.
+type Migration func(record map[string]interface{}) (map[string]interface{}, error)
+
+// envelope wraps every value a proxy writes with the schema version of
+// its type when Options.SchemaEnvelope is set. Bare values are read as
+// version 0.
+type envelope[T any] struct {
+	Schema int `json:"_schema" msgpack:"_schema"`
+	Value  *T  `json:"_value" msgpack:"_value"`
+}
+
+type schema struct {
+	version    int
+	migrations map[int]Migration
+}
+
+var schemas = struct {
+	sync.RWMutex
+	types map[reflect.Type]*schema
+}{types: make(map[reflect.Type]*schema)}
+
+// RegisterMigration registers fn to upgrade records of T from schema
+// version from to from+1. The current version of T is the highest
+// registered from+1, 1 when nothing was registered. A nil fn bumps
+// the version without changing the record, for additive changes that
+// older agents must not overwrite. Register migrations before the
+// proxies of T are used. Versions are only recorded with
+// Options.SchemaEnvelope, without it every value is migrated from
+// version 0 on each read.
+func RegisterMigration[T any](from int, fn Migration) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	schemas.Lock()
+	defer schemas.Unlock()
+	s, ok := schemas.types[t]
+	if !ok {
+		s = &schema{version: 1, migrations: make(map[int]Migration)}
+		schemas.types[t] = s
+	}
+	s.migrations[from] = fn
+	if from+1 > s.version {
+		s.version = from + 1
+	}
+}
+
+// SchemaVersion returns the current schema version of T.
+func SchemaVersion[T any]() int {
+	return schemaOf[T]().version
+}
+
+func schemaOf[T any]() *schema {
+	schemas.RLock()
+	defer schemas.RUnlock()
+	if s, ok := schemas.types[reflect.TypeOf((*T)(nil)).Elem()]; ok {
+		return s
+	}
+	return &schema{version: 1}
+}
+
+func (c *Proxy[T]) encode(value *T) ([]byte, error) {
+	if !c.envelope {
+		return c.codec.Marshal(value)
+	}
+	return c.codec.Marshal(&envelope[T]{Schema: schemaOf[T]().version, Value: value})
+}
+
+// decode upgrades records of an older schema on the way. Records of a
+// newer schema decode as far as this T knows them.
+func (c *Proxy[T]) decode(data []byte) (*T, error) {
+	e := &envelope[T]{}
+	if err := c.codec.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	s := schemaOf[T]()
+	if e.Schema >= s.version {
+		if e.Value == nil {
+			return nil, fmt.Errorf("record of schema %d has no value", e.Schema)
+		}
+		return e.Value, nil
+	}
+	return c.migrate(data, e.Schema, s)
+}
+
+func (c *Proxy[T]) migrate(data []byte, from int, s *schema) (*T, error) {
+	var record map[string]interface{}
+	if from == 0 {
+		if err := c.codec.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+	} else {
+		e := &envelope[map[string]interface{}]{}
+		if err := c.codec.Unmarshal(data, e); err != nil {
+			return nil, err
+		}
+		if e.Value != nil {
+			record = *e.Value
+		}
+	}
+	var err error
+	for v := from; v < s.version; v++ {
+		fn := s.migrations[v]
+		if fn == nil {
+			continue
+		}
+		if record, err = fn(record); err != nil {
+			return nil, fmt.Errorf("migrating schema %d to %d: %v", v, v+1, err)
+		}
+	}
+	bv, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	t := new(T)
+	if err := json.Unmarshal(bv, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// schemaVersion reads the schema version of a stored record.
+func (c *Proxy[T]) schemaVersion(data []byte) int {
+	e := &envelope[struct{}]{}
+	if err := c.codec.Unmarshal(data, e); err != nil {
+		return 0
+	}
+	return e.Schema
+}
@@ -0,0 +1,101 @@
+package kvstore
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type rec struct {
+	Name  string
+	Count int
+}
+
+// registerMigration registers fn for the duration of the test only
+func registerMigration[T any](t *testing.T, from int, fn Migration) {
+	RegisterMigration[T](from, fn)
+	t.Cleanup(func() {
+		schemas.Lock()
+		defer schemas.Unlock()
+		delete(schemas.types, reflect.TypeOf((*T)(nil)).Elem())
+	})
+}
+
+func TestSchemaMigrate(t *testing.T) {
+	k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, RootPath: "root", Collections: CollectionNodes, SchemaEnvelope: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	// legacy bare value
+	if err := k.Store.Put("root/recs/a", []byte(`{"Name":"a","Old":3}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	registerMigration[rec](t, 1, func(m map[string]interface{}) (map[string]interface{}, error) {
+		m["Count"] = m["Old"]
+		return m, nil
+	})
+	p, err := NewProxy[rec](k, "root/recs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := p.Get("a")
+	if err != nil || v.Count != 3 {
+		t.Fatal(v, err)
+	}
+	r, err := p.Migrate()
+	if err != nil || len(r.Updated) != 1 {
+		t.Fatal(r, err)
+	}
+	kv, err := k.Store.Get("root/recs/a")
+	if err != nil || p.schemaVersion(kv.Value) != 2 {
+		t.Fatal(kv, err)
+	}
+	if _, err := k.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	// newer schema is not overwritten by Sync
+	if err := k.Store.Put("root/recs/b", []byte(`{"_schema":9,"_value":{"Name":"b","Count":1,"New":true}}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := p.Plan(map[string]*rec{"a": {"a", 3}, "b": {"b", 2}})
+	if err != nil || len(plan.Update) != 0 {
+		t.Fatal(plan, err)
+	}
+}
+
+func TestSchemaEnvelope(t *testing.T) {
+	for _, tc := range []struct {
+		envelope bool
+		migrate  bool
+	}{
+		{false, false},
+		{true, true},
+	} {
+		k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, RootPath: "root", Collections: CollectionNodes, SchemaEnvelope: tc.envelope})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewProxy[rec](k, "root/recs", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Put("a", &rec{"a", 1}); err != nil {
+			t.Fatal(err)
+		}
+		kv, err := k.Store.Get("root/recs/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(kv.Value), "_schema") != tc.envelope {
+			t.Fatal(tc.envelope, string(kv.Value))
+		}
+		if v, err := p.Get("a"); err != nil || v.Count != 1 {
+			t.Fatal(v, err)
+		}
+		if _, err := p.Migrate(); (err == nil) != tc.migrate {
+			t.Fatal(tc.envelope, err)
+		}
+		k.Close()
+	}
+}
@@ -1,19 +1,19 @@
 package kvstore
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/docker/docker/api/types/swarm"
-	"path"
-	"path/filepath"
+	"github.com/shipdock/libkv/store"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const INGRESS_NETWORK_PREFIX = "10.255."
 const MAX_RETRY_COUNT = 10
-const RETRY_TERM = 1*time.Second
+const RETRY_TERM = 1 * time.Second
 
 const (
 	VirtualIPTypeShipdock = "shipdock"
@@ -35,27 +35,20 @@ type Service struct {
 }
 
 type Services struct {
-	proxy *Proxy
+	proxy *Proxy[Service]
+	mu    sync.Mutex
+	wait  *RetryPolicy
 }
 
 func NewServices(kvstore *KVStore) (*Services, error) {
-	rootPath := TrimRelative(filepath.Clean(path.Join(kvstore.RootPath, "services")))
-	p, err := NewProxy(
-		kvstore,
-		rootPath,
-		func(v []byte) (interface{}, error) {
-			s := &Service{}
-			err := json.Unmarshal(v, s)
-			if err != nil {
-				return nil, err
-			}
-			return s, nil
-		}, nil)
+	p, err := NewCollectionProxy[Service](kvstore, nil, "services")
 	if err != nil {
 		return nil, err
 	}
+	cacheCollection(kvstore, p)
 	service := &Services{
 		proxy: p,
+		wait:  defaultServiceWait,
 	}
 	return service, nil
 }
@@ -147,34 +140,70 @@ func (ss *Services) Put(service *swarm.Service) error {
 	return ss.proxy.Put(v.Name, v)
 }
 
+// PutContext stores service by name, see Proxy.PutContext for ctx
+func (ss *Services) PutContext(ctx context.Context, service *swarm.Service) error {
+	v := ss.NewService(service)
+	return ss.proxy.PutContext(ctx, v.Name, v)
+}
+
 func (ss *Services) Delete(k string) error {
 	return ss.proxy.Delete(k)
 }
 
-func (ss *Services) tryGetUntil(k string) (interface{}, error) {
-	v, err := ss.proxy.Get(k)
-	if err == nil && v != nil {
-		return v, nil
-	}
-	for i:=0; i < MAX_RETRY_COUNT; i++ {
-		time.Sleep(RETRY_TERM)
-		v, err := ss.proxy.Get(k)
-		if err == nil && v != nil {
-			return v, nil
+func (ss *Services) DeleteContext(ctx context.Context, k string) error {
+	return ss.proxy.DeleteContext(ctx, k)
+}
+
+// PutTxn queues the Put in txn, see KVStore.Begin
+func (ss *Services) PutTxn(txn *Txn, service *swarm.Service) error {
+	v := ss.NewService(service)
+	return ss.proxy.PutTxn(txn, v.Name, v)
+}
+
+func (ss *Services) DeleteTxn(txn *Txn, k string) error {
+	return ss.proxy.DeleteTxn(txn, k)
+}
+
+// SetWaitPolicy sets how long Get waits for a service which is not
+// written yet, its Retryable is not used. nil does not wait. The reads
+// themselves are retried under the retry policy.
+func (ss *Services) SetWaitPolicy(policy *RetryPolicy) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.wait = policy
+}
+
+// waitFor gets k, waiting for it to be written under the wait policy.
+func (ss *Services) waitFor(ctx context.Context, k string) (*Service, error) {
+	ss.mu.Lock()
+	policy := ss.wait
+	ss.mu.Unlock()
+	if policy != nil {
+		wait := *policy
+		wait.Retryable = func(err error) bool {
+			return err == store.ErrKeyNotFound
 		}
+		policy = &wait
 	}
-	return nil, err
+	var v *Service
+	err := policy.Do(ctx, func() (err error) {
+		v, err = ss.proxy.GetContext(ctx, k)
+		return err
+	})
+	return v, err
 }
 
 func (ss *Services) Get(sn, id string) (*Service, error) {
-	v, err := ss.tryGetUntil(sn)
+	return ss.GetContext(context.Background(), sn, id)
+}
+
+// GetContext is Get which stops waiting for the service when ctx is
+// done.
+func (ss *Services) GetContext(ctx context.Context, sn, id string) (*Service, error) {
+	cv, err := ss.waitFor(ctx, sn)
 	if err != nil {
 		return nil, err
 	}
-	cv, ok := v.(*Service)
-	if !ok {
-		return nil, fmt.Errorf("type assertion failed")
-	}
 	if cv.ID != id {
 		return nil, fmt.Errorf("key not found : %s:%s", sn, id)
 	}
@@ -182,21 +211,58 @@ func (ss *Services) Get(sn, id string) (*Service, error) {
 }
 
 func (ss *Services) List(recursive bool) (map[string]*Service, error) {
-	im, err := ss.proxy.List(recursive)
-	if err != nil {
-		return nil, err
-	}
-	rs := make(map[string]*Service)
-	for k, v := range im {
-		rs[k] = v.(*Service)
-	}
-	return rs, nil
+	return ss.proxy.List(recursive)
 }
 
-func (ss *Services) Sync(ls []swarm.Service) error {
-	lsm := make(map[string]interface{})
+func (ss *Services) ListContext(ctx context.Context, recursive bool) (map[string]*Service, error) {
+	return ss.proxy.ListContext(ctx, recursive)
+}
+
+// ListWithFailures also returns the services which can not be decoded,
+// unlike Get it does not wait for services to be written
+func (ss *Services) ListWithFailures(recursive bool) (map[string]*Service, []*DecodeFailure, error) {
+	return ss.proxy.ListWithFailures(recursive)
+}
+
+// SetRetryPolicy applies to the backend calls of the services, how long
+// Get waits for a missing service is set with SetWaitPolicy
+func (ss *Services) SetRetryPolicy(policy *RetryPolicy) {
+	ss.proxy.SetRetryPolicy(policy)
+}
+
+func (ss *Services) Watch(ctx context.Context) (<-chan Event[Service], error) {
+	return ss.proxy.Watch(ctx)
+}
+
+func (ss *Services) local(ls []swarm.Service) map[string]*Service {
+	lsm := make(map[string]*Service)
 	for _, s := range ls {
 		lsm[s.Spec.Name] = ss.NewService(&s)
 	}
-	return ss.proxy.Sync(lsm)
+	return lsm
+}
+
+// Plan returns what Sync(ls) would change without writing anything
+func (ss *Services) Plan(ls []swarm.Service) (*Plan[Service], error) {
+	return ss.proxy.Plan(ss.local(ls))
+}
+
+func (ss *Services) PlanContext(ctx context.Context, ls []swarm.Service) (*Plan[Service], error) {
+	return ss.proxy.PlanContext(ctx, ss.local(ls))
+}
+
+func (ss *Services) Apply(plan *Plan[Service]) (*SyncResult, error) {
+	return ss.proxy.Apply(plan)
+}
+
+func (ss *Services) ApplyContext(ctx context.Context, plan *Plan[Service]) (*SyncResult, error) {
+	return ss.proxy.ApplyContext(ctx, plan)
+}
+
+func (ss *Services) Sync(ls []swarm.Service) (*SyncResult, error) {
+	return ss.proxy.Sync(ss.local(ls))
+}
+
+func (ss *Services) SyncContext(ctx context.Context, ls []swarm.Service) (*SyncResult, error) {
+	return ss.proxy.SyncContext(ctx, ss.local(ls))
 }
@@ -0,0 +1,265 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_RECONNECT_FAILURES = 3
+
+type ConnectionState int
+
+const (
+	StateConnected ConnectionState = iota
+	StateDisconnected
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+type StateChangeFunc func(state ConnectionState, err error)
+
+type Health struct {
+	State   ConnectionState
+	Latency time.Duration
+	// Endpoint is the member serving requests. Backends whose client
+	// balances members internally (etcd, zookeeper) report the list.
+	Endpoint string
+	Err      error
+}
+
+// supervisedStore forwards to the current backend store, which the
+// supervisor replaces on reconnect. Callers keep using KVStore.Store
+// and the proxies across reconnects.
+type supervisedStore struct {
+	mu sync.RWMutex
+	s  store.Store
+}
+
+func (ss *supervisedStore) current() store.Store {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.s
+}
+
+func (ss *supervisedStore) swap(s store.Store) store.Store {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	old := ss.s
+	ss.s = s
+	return old
+}
+
+func (ss *supervisedStore) withContext(ctx context.Context) store.Store {
+	return withContext(ctx, ss.current())
+}
+
+func (ss *supervisedStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	return ss.current().Put(key, value, options)
+}
+
+func (ss *supervisedStore) Get(key string) (*store.KVPair, error) {
+	return ss.current().Get(key)
+}
+
+func (ss *supervisedStore) Delete(key string) error {
+	return ss.current().Delete(key)
+}
+
+func (ss *supervisedStore) Exists(key string) (bool, error) {
+	return ss.current().Exists(key)
+}
+
+func (ss *supervisedStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return ss.current().Watch(key, stopCh)
+}
+
+func (ss *supervisedStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return ss.current().WatchTree(directory, stopCh)
+}
+
+func (ss *supervisedStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return ss.current().NewLock(key, options)
+}
+
+func (ss *supervisedStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	return ss.current().List(directory, recursive)
+}
+
+func (ss *supervisedStore) DeleteTree(directory string) error {
+	return ss.current().DeleteTree(directory)
+}
+
+func (ss *supervisedStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	return ss.current().AtomicPut(key, value, previous, options)
+}
+
+func (ss *supervisedStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	return ss.current().AtomicDelete(key, previous)
+}
+
+func (ss *supervisedStore) Close() {
+	ss.current().Close()
+}
+
+// Ping checks the backend with a single read of RootPath, bounded by the
+// connection timeout.
+func (k *KVStore) Ping() (*Health, error) {
+	timeout := DEFAULT_CONNECTION_TIMEOUT
+	if k.opts != nil && k.opts.ConnectionTimeout > 0 {
+		timeout = k.opts.ConnectionTimeout
+	}
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := k.Store.Exists(k.RootPath)
+		errCh <- err
+	}()
+	health := &Health{State: StateConnected, Endpoint: k.endpoint()}
+	select {
+	case health.Err = <-errCh:
+	case <-time.After(timeout):
+		health.Err = fmt.Errorf("ping timed out after %s", timeout)
+	}
+	health.Latency = time.Since(start)
+	if health.Err != nil {
+		health.State = StateDisconnected
+	}
+	return health, health.Err
+}
+
+func (k *KVStore) endpoint() string {
+	if k.opts == nil {
+		return ""
+	}
+	if f, ok := k.supervised.current().(*failoverStore); ok {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.endpoints[f.current]
+	}
+	return strings.Join(k.opts.Endpoints, ",")
+}
+
+// Reconnect replaces the backend store with a freshly opened one.
+// Watches running on the old store end, the ones of Proxy.Watch and of
+// the caches are restarted on the new one. The in-process store has no
+// connection and is kept, reopening an unnamed one would drop its data.
+func (k *KVStore) Reconnect() error {
+	if k.opts == nil {
+		return fmt.Errorf("kvstore was not created by NewKVStoreWithOptions, can not reconnect")
+	}
+	if k.opts.Backend == MEMORY {
+		return nil
+	}
+	s, err := openStore(k.opts)
+	if err != nil {
+		return err
+	}
+	k.Logger().Infof("kvstore reconnected to %s", strings.Join(k.opts.Endpoints, ","))
+	k.supervised.swap(s).Close()
+	return nil
+}
+
+// State returns the connection state last seen by the supervisor.
+func (k *KVStore) State() ConnectionState {
+	k.stateMu.Lock()
+	defer k.stateMu.Unlock()
+	return k.state
+}
+
+// OnStateChange registers fn to be called by the supervisor whenever the
+// backend goes from connected to disconnected or back.
+func (k *KVStore) OnStateChange(fn StateChangeFunc) {
+	k.stateMu.Lock()
+	defer k.stateMu.Unlock()
+	k.stateFuncs = append(k.stateFuncs, fn)
+}
+
+func (k *KVStore) setState(state ConnectionState, err error) {
+	k.stateMu.Lock()
+	if k.state == state {
+		k.stateMu.Unlock()
+		return
+	}
+	k.state = state
+	funcs := append([]StateChangeFunc(nil), k.stateFuncs...)
+	k.stateMu.Unlock()
+	if err != nil {
+		k.Logger().Warnf("kvstore %s: %v", state, err)
+	} else {
+		k.Logger().Infof("kvstore %s", state)
+	}
+	for _, fn := range funcs {
+		fn(state, err)
+	}
+}
+
+// supervise pings the backend every interval and rebuilds the store
+// after maxFailures consecutive failed pings.
+func (k *KVStore) supervise(interval time.Duration, maxFailures int, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		if _, err := k.Ping(); err == nil {
+			failures = 0
+			k.setState(StateConnected, nil)
+			continue
+		} else {
+			failures++
+			k.setState(StateDisconnected, err)
+		}
+		if failures < maxFailures {
+			continue
+		}
+		if err := k.Reconnect(); err != nil {
+			k.Logger().Warnf("kvstore reconnect failed: %v", err)
+			continue
+		}
+		failures = 0
+	}
+}
+
+func (ss *supervisedStore) commit(ctx context.Context, ops []*txnOp) ([]*store.KVPair, error) {
+	if ts, ok := ss.current().(txnStore); ok {
+		return ts.commit(ctx, ops)
+	}
+	return nil, errTxnNotSupported
+}
+
+func (ss *supervisedStore) grant(ctx context.Context, ttl time.Duration) (string, error) {
+	if ls, ok := ss.current().(leaseStore); ok {
+		return ls.grant(ctx, ttl)
+	}
+	return "", ErrLeaseNotSupported
+}
+
+func (ss *supervisedStore) renew(ctx context.Context, id string) error {
+	if ls, ok := ss.current().(leaseStore); ok {
+		return ls.renew(ctx, id)
+	}
+	return ErrLeaseNotSupported
+}
+
+func (ss *supervisedStore) revoke(ctx context.Context, id string) error {
+	if ls, ok := ss.current().(leaseStore); ok {
+		return ls.revoke(ctx, id)
+	}
+	return ErrLeaseNotSupported
+}
@@ -0,0 +1,160 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/shipdock/libkv/store"
+	"sync"
+	"testing"
+	"time"
+)
+
+// downStore fails every read like an unreachable backend, or hangs in
+// them when hang is set.
+type downStore struct {
+	store.Store
+	hang bool
+}
+
+func (s *downStore) Exists(key string) (bool, error) {
+	if s.hang {
+		time.Sleep(time.Second)
+	}
+	return false, store.ErrNotReachable
+}
+
+func TestPing(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		wrap  func(s store.Store) store.Store
+		state ConnectionState
+	}{
+		{"up", func(s store.Store) store.Store { return s }, StateConnected},
+		{"down", func(s store.Store) store.Store { return &downStore{Store: s} }, StateDisconnected},
+		{"hanging", func(s store.Store) store.Store { return &downStore{Store: s, hang: true} }, StateDisconnected},
+	} {
+		k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, RootPath: "root", NodeName: "h1", ConnectionTimeout: 50 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.supervised.swap(tc.wrap(k.supervised.current()))
+		h, err := k.Ping()
+		if h.State != tc.state || (err == nil) != (tc.state == StateConnected) {
+			t.Fatal(tc.name, h, err)
+		}
+		if h.Latency > 500*time.Millisecond {
+			t.Fatal(tc.name, "ping not bounded by the connection timeout", h.Latency)
+		}
+		k.Close()
+	}
+}
+
+func TestSupervisorReconnects(t *testing.T) {
+	k, err := NewKVStoreWithOptions(&Options{Backend: FILE, Endpoints: []string{t.TempDir()}, RootPath: "root", NodeName: "h1", HealthCheckInterval: 10 * time.Millisecond, ReconnectFailures: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	var mu sync.Mutex
+	states := make([]ConnectionState, 0)
+	k.OnStateChange(func(state ConnectionState, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+	})
+	k.supervised.swap(&downStore{Store: k.supervised.current()})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(states)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no reconnect", states)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if states[0] != StateDisconnected || states[1] != StateConnected || k.State() != StateConnected {
+		t.Fatal(states)
+	}
+}
+
+func TestReconnectRestartsWatches(t *testing.T) {
+	k, err := NewKVStoreWithOptions(&Options{Backend: FILE, Endpoints: []string{t.TempDir()}, RootPath: "root", NodeName: "h1", Collections: CollectionVolumes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := k.Volumes.proxy.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	// the watch moves to the new store within WATCH_RETRY_MIN, writes
+	// are repeated until it sees one
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; ; i++ {
+		if err := k.Volumes.proxy.Put("v", &Volume{Name: "v", Driver: string(rune('a' + i%26))}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case e := <-ch:
+			if e.Key != "v" {
+				t.Fatal(e)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watch silent after reconnect")
+		}
+	}
+}
+
+func TestReconnectKeepsMemory(t *testing.T) {
+	k, err := NewKVStore("mem:///root", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if err := k.Put("root/a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := k.Store.Exists("root/a"); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	opts := &Options{Backend: MEMORY, Endpoints: []string{"closetwice"}, RootPath: "root", NodeName: "h1"}
+	k1, err := NewKVStoreWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Logger != nil {
+		t.Fatal("the options of the caller were changed")
+	}
+	k2, err := NewKVStoreWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k2.Close()
+	if err := k2.Put("root/a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	k1.Close()
+	k1.Close()
+	if ok, err := k2.Store.Exists("root/a"); !ok || err != nil {
+		t.Fatal("a second Close closed the shared store", ok, err)
+	}
+}
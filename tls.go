@@ -0,0 +1,101 @@
+package kvstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// TLSOptions configures the backend connection for TLS. A CA bundle
+// alone verifies the server, a client certificate and key pair add
+// mutual TLS.
+type TLSOptions struct {
+	CACertFile         string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// ParseTLSOptions reads TLS settings from store url query parameters:
+// tls=true, ca=, cert=, key=, server_name= and insecure_skip_verify=.
+// It returns nil when the url does not ask for TLS.
+func ParseTLSOptions(query url.Values) (*TLSOptions, error) {
+	o := &TLSOptions{
+		CACertFile: query.Get("ca"),
+		CertFile:   query.Get("cert"),
+		KeyFile:    query.Get("key"),
+		ServerName: query.Get("server_name"),
+	}
+	enabled := len(o.CACertFile) > 0 || len(o.CertFile) > 0 || len(o.KeyFile) > 0 || len(o.ServerName) > 0
+	if v := query.Get("tls"); len(v) > 0 {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls value: %s", v)
+		}
+		enabled = b
+	}
+	if v := query.Get("insecure_skip_verify"); len(v) > 0 {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid insecure_skip_verify value: %s", v)
+		}
+		o.InsecureSkipVerify = b
+	}
+	if !enabled && !o.InsecureSkipVerify {
+		return nil, nil
+	}
+	return o, nil
+}
+
+func (o *TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if len(o.CACertFile) > 0 {
+		pem, err := os.ReadFile(o.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle: %s", o.CACertFile)
+		}
+		config.RootCAs = pool
+	}
+	if len(o.CertFile) > 0 || len(o.KeyFile) > 0 {
+		if len(o.CertFile) == 0 || len(o.KeyFile) == 0 {
+			return nil, fmt.Errorf("client certificate and key must be given together (cert:%s, key:%s)", o.CertFile, o.KeyFile)
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// apply fills store.Config for both libkv clients: TLS carries the
+// complete client configuration, ClientTLS the file locations.
+func (o *TLSOptions) apply(config *store.Config) error {
+	tlsConfig, err := o.Config()
+	if err != nil {
+		return err
+	}
+	config.TLS = tlsConfig
+	if len(o.CertFile) > 0 {
+		config.ClientTLS = &store.ClientTLSConfig{
+			CertFile:   o.CertFile,
+			KeyFile:    o.KeyFile,
+			CACertFile: o.CACertFile,
+		}
+	}
+	return nil
+}
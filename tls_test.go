@@ -0,0 +1,51 @@
+package kvstore
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseTLSOptions(t *testing.T) {
+	for _, tc := range []struct {
+		query   string
+		options *TLSOptions
+		fails   bool
+	}{
+		{query: ""},
+		{query: "tls=false&ca=/ca.pem"},
+		{query: "tls=true", options: &TLSOptions{}},
+		{query: "ca=/ca.pem", options: &TLSOptions{CACertFile: "/ca.pem"}},
+		{query: "server_name=kv", options: &TLSOptions{ServerName: "kv"}},
+		{query: "cert=/c.pem&key=/k.pem&ca=/ca.pem", options: &TLSOptions{CACertFile: "/ca.pem", CertFile: "/c.pem", KeyFile: "/k.pem"}},
+		{query: "insecure_skip_verify=true", options: &TLSOptions{InsecureSkipVerify: true}},
+		{query: "tls=yes", fails: true},
+		{query: "insecure_skip_verify=no?", fails: true},
+	} {
+		query, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options, err := ParseTLSOptions(query)
+		if tc.fails {
+			if err == nil {
+				t.Fatal(tc.query, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(tc.query, err)
+		}
+		if !reflect.DeepEqual(options, tc.options) {
+			t.Fatal(tc.query, options)
+		}
+	}
+}
+
+func TestTLSConfigNeedsCertAndKey(t *testing.T) {
+	for _, o := range []*TLSOptions{{CertFile: "/c.pem"}, {KeyFile: "/k.pem"}} {
+		if _, err := o.Config(); err == nil {
+			t.Fatal(o)
+		}
+	}
+}
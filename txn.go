@@ -0,0 +1,367 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	log "github.com/sirupsen/logrus"
+	"path"
+)
+
+type txnVerb int
+
+const (
+	txnPut txnVerb = iota
+	txnDelete
+)
+
+func (v txnVerb) String() string {
+	if v == txnDelete {
+		return "DELETE"
+	}
+	return "PUT"
+}
+
+type txnOp struct {
+	verb  txnVerb
+	key   string
+	value []byte
+	// compare and swap against previous, an absent key when nil
+	cas      bool
+	previous *store.KVPair
+	// ties the key to a lease, see lease.go
+	lease *Lease
+	// called with the written pair (nil for deletes) after commit
+	done func(kv *store.KVPair)
+}
+
+// txnStore is implemented by the stores which can apply several
+// operations at once (the in-process store and consul). commit applies
+// all of ops or none of them and returns the written pairs in op order,
+// giving up when ctx is done. Wrappers forward to the store they wrap
+// and return errTxnNotSupported when that one has no transactions.
+type txnStore interface {
+	commit(ctx context.Context, ops []*txnOp) ([]*store.KVPair, error)
+}
+
+var errTxnNotSupported = errors.New("transactions are not supported by this store")
+
+// Txn groups writes to several keys, which other readers see all at once
+// after Commit or not at all. Consul commits through its txn endpoint
+// (at most CONSUL_TXN_MAX_OPS operations) and the in-process store under
+// its lock. The other backends have no multi-key transactions in their
+// libkv clients (etcd is spoken to through the v2 API), for them Commit
+// applies the operations one by one and undoes the applied ones when a
+// later one fails. Readers can see the intermediate states there, and
+// the rollback itself fails if someone wrote the same keys meanwhile.
+type Txn struct {
+	s      store.Store
+	codec  Codec
+	logger log.FieldLogger
+	ops    []*txnOp
+	done   bool
+}
+
+// Begin starts a transaction, values given to Txn.Put are encoded with
+// the KVStore codec like KVStore.Put.
+func (k *KVStore) Begin() *Txn {
+	return newTxn(k.Store, k.Codec(), k.Logger())
+}
+
+func newTxn(s store.Store, codec Codec, logger log.FieldLogger) *Txn {
+	return &Txn{s: s, codec: codec, logger: logger}
+}
+
+func (t *Txn) add(op *txnOp) error {
+	if t.done {
+		return fmt.Errorf("transaction is already committed")
+	}
+	t.ops = append(t.ops, op)
+	return nil
+}
+
+func (t *Txn) Put(key string, val interface{}) error {
+	bv, err := t.codec.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return t.add(&txnOp{verb: txnPut, key: key, value: bv})
+}
+
+// Delete removes key, a missing key is not an error.
+func (t *Txn) Delete(key string) error {
+	return t.add(&txnOp{verb: txnDelete, key: key})
+}
+
+// Len returns the number of operations queued so far.
+func (t *Txn) Len() int {
+	return len(t.ops)
+}
+
+// Commit applies the queued operations. A failing operation is
+// returned as a *KeyError, compare and swap failures wrap the store
+// errors (store.ErrKeyModified, store.ErrKeyExists).
+func (t *Txn) Commit() error {
+	return t.CommitContext(context.Background())
+}
+
+// CommitContext is Commit which gives up when ctx is done. Stores
+// without transactions still roll back the operations applied so far.
+func (t *Txn) CommitContext(ctx context.Context) error {
+	if t.done {
+		return fmt.Errorf("transaction is already committed")
+	}
+	t.done = true
+	if len(t.ops) == 0 {
+		return nil
+	}
+	for _, op := range t.ops {
+		t.logger.Debugf("TXN %s:%s", op.verb, op.key)
+	}
+	kvs, err := commit(ctx, t.s, t.ops, t.logger)
+	if err != nil {
+		return err
+	}
+	for i, op := range t.ops {
+		if op.lease != nil {
+			if op.verb == txnPut {
+				op.lease.bind(op.key)
+			} else {
+				op.lease.unbind(op.key)
+			}
+		}
+		if op.done != nil {
+			op.done(kvs[i])
+		}
+	}
+	return nil
+}
+
+func commit(ctx context.Context, s store.Store, ops []*txnOp, logger log.FieldLogger) ([]*store.KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ts, ok := s.(txnStore); ok {
+		kvs, err := ts.commit(ctx, ops)
+		if err != errTxnNotSupported {
+			return kvs, err
+		}
+	}
+	return commitSequential(ctx, s, ops, logger)
+}
+
+// commitSequential is the fallback for stores without transactions.
+// ctx is checked between the operations only, an operation given up on
+// might still be applied after the rollback. The rollback runs to the
+// end even when ctx is done.
+func commitSequential(ctx context.Context, s store.Store, ops []*txnOp, logger log.FieldLogger) ([]*store.KVPair, error) {
+	kvs := make([]*store.KVPair, len(ops))
+	befores := make([]*store.KVPair, len(ops))
+	for i, op := range ops {
+		if err := ctx.Err(); err != nil {
+			rollback(s, ops[:i], befores, kvs, logger)
+			return nil, err
+		}
+		before, err := s.Get(op.key)
+		if err != nil && err != store.ErrKeyNotFound {
+			rollback(s, ops[:i], befores, kvs, logger)
+			return nil, &KeyError{Key: op.key, Err: err}
+		}
+		befores[i] = before
+		if kvs[i], err = applyOp(s, op); err != nil {
+			rollback(s, ops[:i], befores, kvs, logger)
+			return nil, &KeyError{Key: op.key, Err: err}
+		}
+	}
+	return kvs, nil
+}
+
+func applyOp(s store.Store, op *txnOp) (*store.KVPair, error) {
+	options := &store.WriteOptions{IsDir: false}
+	if op.lease != nil {
+		// only emulated leases get here, see Lease
+		options.TTL = op.lease.ttl
+	}
+	switch {
+	case op.verb == txnPut && op.cas:
+		_, kv, err := s.AtomicPut(op.key, op.value, op.previous, options)
+		return kv, err
+	case op.verb == txnPut:
+		if err := s.Put(op.key, op.value, options); err != nil {
+			return nil, err
+		}
+		return s.Get(op.key)
+	case op.cas:
+		if op.previous == nil {
+			return nil, store.ErrPreviousNotSpecified
+		}
+		_, err := s.AtomicDelete(op.key, op.previous)
+		return nil, err
+	}
+	if err := s.Delete(op.key); err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// rollback restores the keys of the applied ops in reverse order, with
+// compare and swap so that it does not overwrite other writers.
+func rollback(s store.Store, applied []*txnOp, befores, kvs []*store.KVPair, logger log.FieldLogger) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		op, before, after := applied[i], befores[i], kvs[i]
+		var err error
+		switch {
+		case before == nil && after == nil:
+			// deleted a missing key
+		case before == nil:
+			_, err = s.AtomicDelete(op.key, after)
+		case after == nil:
+			_, _, err = s.AtomicPut(op.key, before.Value, nil, &store.WriteOptions{IsDir: false})
+		default:
+			_, _, err = s.AtomicPut(op.key, before.Value, after, &store.WriteOptions{IsDir: false})
+		}
+		if err != nil {
+			logger.Warnf("TXN rollback of %s failed: %v", op.key, err)
+		}
+	}
+}
+
+// check verifies the compare and swap condition of op against current,
+// for the stores committing natively.
+func (op *txnOp) check(current *store.KVPair) error {
+	if !op.cas {
+		return nil
+	}
+	if op.verb == txnDelete && op.previous == nil {
+		return store.ErrPreviousNotSpecified
+	}
+	if op.previous == nil {
+		if current != nil {
+			return store.ErrKeyExists
+		}
+		return nil
+	}
+	if current == nil {
+		return store.ErrKeyNotFound
+	}
+	if current.LastIndex != op.previous.LastIndex {
+		return store.ErrKeyModified
+	}
+	return nil
+}
+
+// PutTxn queues value for key in txn, encoded with the proxy codec.
+func (c *Proxy[T]) PutTxn(txn *Txn, key string, value *T) error {
+	return c.txnPut(txn, key, value, false, nil, c.currentLease())
+}
+
+func (c *Proxy[T]) DeleteTxn(txn *Txn, key string) error {
+	return c.txnDelete(txn, key, false, nil, c.currentLease())
+}
+
+func (c *Proxy[T]) txnPut(txn *Txn, key string, value *T, cas bool, previous *store.KVPair, lease *Lease) error {
+	bv, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	return txn.add(&txnOp{verb: txnPut, key: path.Join(c.rootPath, key), value: bv, cas: cas, previous: previous, lease: lease, done: func(kv *store.KVPair) {
+		c.invalidateCache()
+		if kv != nil {
+			c.remember(key, kv.LastIndex)
+		}
+	}})
+}
+
+func (c *Proxy[T]) txnDelete(txn *Txn, key string, cas bool, previous *store.KVPair, lease *Lease) error {
+	return txn.add(&txnOp{verb: txnDelete, key: path.Join(c.rootPath, key), cas: cas, previous: previous, lease: lease, done: func(kv *store.KVPair) {
+		c.invalidateCache()
+		c.forget(key)
+	}})
+}
+
+// SetBatchSize makes Sync/Apply of this proxy commit up to n changes
+// per transaction, zero writes the changes one by one. It fails when
+// such a transaction would be too large for the store.
+func (c *Proxy[T]) SetBatchSize(n int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := checkBatchSize(c.parent.backend(), n, c.lease != nil); err != nil {
+		return err
+	}
+	c.batchSize = n
+	return nil
+}
+
+func (c *Proxy[T]) currentBatchSize() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batchSize
+}
+
+// checkBatchSize fails for batches of n changes which do not fit a
+// consul transaction, where a leased change takes two operations.
+func checkBatchSize(backend store.Backend, n int, leased bool) error {
+	if backend != store.CONSUL {
+		return nil
+	}
+	ops := n
+	if leased {
+		ops = 2 * n
+	}
+	if ops > CONSUL_TXN_MAX_OPS {
+		return fmt.Errorf("consul: a batch of %d changes takes %d operations, a transaction at most %d", n, ops, CONSUL_TXN_MAX_OPS)
+	}
+	return nil
+}
+
+// applyBatches commits changes in transactions of size changes on the
+// proxy's worker pool. A failing batch fails all of its changes.
+func (c *Proxy[T]) applyBatches(ctx context.Context, changes []Change[T], size int) []error {
+	failures := make([]error, len(changes))
+	// the lease may have been set after the batch size
+	lease := c.currentLease()
+	if err := checkBatchSize(c.parent.backend(), size, lease != nil); err != nil {
+		for i := range failures {
+			failures[i] = err
+		}
+		return failures
+	}
+	batches := (len(changes) + size - 1) / size
+	errs := c.each(ctx, batches, func(b int) error {
+		start, end := batch(b, size, len(changes))
+		return c.do(ctx, func() error {
+			txn := newTxn(c.kvstore, c.codec, c.logger)
+			for _, change := range changes[start:end] {
+				if err := c.addChange(txn, change, lease); err != nil {
+					return err
+				}
+			}
+			return txn.CommitContext(ctx)
+		})
+	})
+	for b, err := range errs {
+		start, end := batch(b, size, len(changes))
+		for i := start; i < end; i++ {
+			failures[i] = err
+		}
+	}
+	return failures
+}
+
+// batch returns the range of the n changes in batch b.
+func batch(b, size, n int) (int, int) {
+	start := b * size
+	end := start + size
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+func (c *Proxy[T]) addChange(txn *Txn, change Change[T], lease *Lease) error {
+	if change.New == nil {
+		return c.txnDelete(txn, change.Key, true, change.previous, lease)
+	}
+	return c.txnPut(txn, change.Key, change.New, true, change.previous, lease)
+}
@@ -0,0 +1,100 @@
+package kvstore
+
+import (
+	"errors"
+	"github.com/shipdock/libkv/store"
+	"testing"
+	"time"
+)
+
+type item struct{ A string }
+
+type plainStore struct{ store.Store }
+
+func TestTxnMem(t *testing.T) {
+	k, err := NewKVStoreWithOptions(&Options{Backend: MEMORY, Endpoints: []string{""}, RootPath: "root", Collections: CollectionNodes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	p, err := NewProxy[item](k, "root/items", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := k.Begin()
+	for key, value := range map[string]*item{"a": {"1"}, "b": {"2"}} {
+		if err := p.PutTxn(txn, key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := p.List(false); err != nil || len(m) != 2 {
+		t.Fatal(m, err)
+	}
+	// conflict -> nothing applied
+	txn = k.Begin()
+	if err := p.PutTxn(txn, "c", &item{"3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.add(&txnOp{verb: txnPut, key: "root/items/a", cas: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); !isConflict(err) {
+		t.Fatal(err)
+	}
+	if _, err := p.Get("c"); err != store.ErrKeyNotFound {
+		t.Fatal("c written", err)
+	}
+	// fallback with rollback
+	txn = newTxn(&plainStore{k.Store}, JSONCodec, k.Logger())
+	if err := txn.Put("root/items/d", &item{"4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete("root/items/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.add(&txnOp{verb: txnPut, key: "root/items/a", cas: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); !errors.Is(err, store.ErrKeyExists) {
+		t.Fatal(err)
+	}
+	if _, err := p.Get("d"); err != store.ErrKeyNotFound {
+		t.Fatal("d not rolled back", err)
+	}
+	if _, err := p.Get("b"); err != nil {
+		t.Fatal("b not restored", err)
+	}
+	// batched sync
+	if err := p.SetBatchSize(2); err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.Sync(map[string]*item{"x": {"x"}, "y": {"y"}, "z": {"z"}})
+	if err != nil || len(res.Created) != 3 || len(res.Deleted) != 2 {
+		t.Fatal(res, err)
+	}
+}
+
+func TestCheckBatchSize(t *testing.T) {
+	for _, tc := range []struct {
+		backend store.Backend
+		n       int
+		leased  bool
+		ok      bool
+	}{
+		{store.CONSUL, CONSUL_TXN_MAX_OPS / 2, true, true},
+		{store.CONSUL, CONSUL_TXN_MAX_OPS/2 + 1, true, false},
+		{store.CONSUL, CONSUL_TXN_MAX_OPS, false, true},
+		{store.CONSUL, CONSUL_TXN_MAX_OPS + 1, false, false},
+		{MEMORY, 1000, true, true},
+	} {
+		if err := checkBatchSize(tc.backend, tc.n, tc.leased); (err == nil) != tc.ok {
+			t.Fatal(tc, err)
+		}
+	}
+	if _, err := NewKVStoreWithOptions(&Options{Backend: store.CONSUL, Endpoints: []string{"127.0.0.1:1"}, SyncBatchSize: 40, AgentLeaseTTL: time.Second}); err == nil {
+		t.Fatal("options not validated")
+	}
+}
@@ -1,12 +1,8 @@
 package kvstore
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	types "github.com/docker/docker/api/types"
-	"os"
-	"path"
-	"path/filepath"
 	"reflect"
 )
 
@@ -39,47 +35,45 @@ func NewVolume(base *types.Volume) *Volume {
 }
 
 type Volumes struct {
-	proxy *Proxy
+	proxy   *Proxy[Volume]
+	kvstore *KVStore
 }
 
-func NewVolumes(kvstore *KVStore) (*Volumes, error) {
-	hostname, err := os.Hostname()
+func newVolumesProxy(kvstore *KVStore, node string) (*Proxy[Volume], error) {
+	p, err := NewCollectionProxy[Volume](kvstore, compareVolume, "volumes", node)
 	if err != nil {
 		return nil, err
 	}
-	rootPath := TrimRelative(filepath.Clean(path.Join(kvstore.RootPath, "volumes", hostname)))
-	p, err := NewProxy(
-		kvstore,
-		rootPath,
-		func(v []byte) (interface{}, error) {
-			s := &Volume{}
-			err := json.Unmarshal(v, s)
-			if err != nil {
-				return nil, err
-			}
-			return s, nil
-		},
-		func(local, remote interface{}) bool {
-			vl := local.(*Volume)
-			vr := remote.(*Volume)
-			if len(vl.Owner) == 0 && len(vr.Owner) == 0 {
-				return reflect.DeepEqual(local, remote)
-			}
-			if len(vl.Owner) == 0 && len(vr.Owner) != 0 {
-				// avoid update
-				return true
-			}
-			if len(vl.Owner) != 0 && len(vr.Owner) == 0 {
-				// must update
-				return false
-			}
-			return reflect.DeepEqual(local, remote)
-		})
+	if node == kvstore.Node && kvstore.agentLease != nil {
+		p.SetLease(kvstore.agentLease)
+	}
+	return p, nil
+}
+
+func compareVolume(vl, vr *Volume) bool {
+	if len(vl.Owner) == 0 && len(vr.Owner) == 0 {
+		return reflect.DeepEqual(vl, vr)
+	}
+	if len(vl.Owner) == 0 && len(vr.Owner) != 0 {
+		// avoid update
+		return true
+	}
+	if len(vl.Owner) != 0 && len(vr.Owner) == 0 {
+		// must update
+		return false
+	}
+	return reflect.DeepEqual(vl, vr)
+}
+
+func NewVolumes(kvstore *KVStore) (*Volumes, error) {
+	p, err := newVolumesProxy(kvstore, kvstore.Node)
 	if err != nil {
 		return nil, err
 	}
+	cacheCollection(kvstore, p)
 	v := &Volumes{
-		proxy: p,
+		proxy:   p,
+		kvstore: kvstore,
 	}
 	return v, nil
 }
@@ -89,38 +83,116 @@ func (ss *Volumes) Put(Volume *types.Volume) error {
 	return ss.proxy.Put(v.Name, v)
 }
 
+// PutContext stores Volume under this host by name, see
+// Proxy.PutContext for ctx
+func (ss *Volumes) PutContext(ctx context.Context, Volume *types.Volume) error {
+	v := NewVolume(Volume)
+	return ss.proxy.PutContext(ctx, v.Name, v)
+}
+
 func (ss *Volumes) Delete(k string) error {
 	return ss.proxy.Delete(k)
 }
 
+func (ss *Volumes) DeleteContext(ctx context.Context, k string) error {
+	return ss.proxy.DeleteContext(ctx, k)
+}
+
+// PutTxn queues the Put in txn, see KVStore.Begin
+func (ss *Volumes) PutTxn(txn *Txn, Volume *types.Volume) error {
+	v := NewVolume(Volume)
+	return ss.proxy.PutTxn(txn, v.Name, v)
+}
+
+func (ss *Volumes) DeleteTxn(txn *Txn, k string) error {
+	return ss.proxy.DeleteTxn(txn, k)
+}
+
 func (ss *Volumes) Get(k string) (*Volume, error) {
-	v, err := ss.proxy.Get(k)
-	if err != nil {
+	return ss.proxy.Get(k)
+}
+
+func (ss *Volumes) GetContext(ctx context.Context, k string) (*Volume, error) {
+	return ss.proxy.GetContext(ctx, k)
+}
+
+func (ss *Volumes) List(recursive bool) (map[string]*Volume, error) {
+	return ss.proxy.List(recursive)
+}
+
+func (ss *Volumes) ListContext(ctx context.Context, recursive bool) (map[string]*Volume, error) {
+	return ss.proxy.ListContext(ctx, recursive)
+}
+
+// ListWithFailures also returns the volumes of this host which can not
+// be decoded
+func (ss *Volumes) ListWithFailures(recursive bool) (map[string]*Volume, []*DecodeFailure, error) {
+	return ss.proxy.ListWithFailures(recursive)
+}
+
+// GetNode returns a volume of another host by its node identity
+func (ss *Volumes) GetNode(node, k string) (*Volume, error) {
+	if err := validateNode(node); err != nil {
 		return nil, err
 	}
-	cv, ok := v.(*Volume)
-	if !ok {
-		return nil, fmt.Errorf("type assertion failed")
+	p, err := newVolumesProxy(ss.kvstore, node)
+	if err != nil {
+		return nil, err
 	}
-	return cv, nil
+	return p.Get(k)
 }
 
-func (ss *Volumes) List(recursive bool) (map[string]*Volume, error) {
-	im, err := ss.proxy.List(recursive)
-	if err != nil {
+// ListNode returns the volume list of another host by its node identity
+func (ss *Volumes) ListNode(node string) (map[string]*Volume, error) {
+	if err := validateNode(node); err != nil {
 		return nil, err
 	}
-	rs := make(map[string]*Volume)
-	for k, v := range im {
-		rs[k] = v.(*Volume)
+	p, err := newVolumesProxy(ss.kvstore, node)
+	if err != nil {
+		return nil, err
 	}
-	return rs, nil
+	return p.List(true)
 }
 
-func (ss *Volumes) Sync(ls []*types.Volume) error {
-	lsm := make(map[string]interface{})
+// SetRetryPolicy applies to the volumes of this host, GetNode and
+// ListNode keep the policy of the KVStore
+func (ss *Volumes) SetRetryPolicy(policy *RetryPolicy) {
+	ss.proxy.SetRetryPolicy(policy)
+}
+
+func (ss *Volumes) Watch(ctx context.Context) (<-chan Event[Volume], error) {
+	return ss.proxy.Watch(ctx)
+}
+
+func (ss *Volumes) local(ls []*types.Volume) map[string]*Volume {
+	lsm := make(map[string]*Volume)
 	for _, s := range ls {
 		lsm[s.Name] = NewVolume(s)
 	}
-	return ss.proxy.Sync(lsm)
+	return lsm
+}
+
+// Plan returns what Sync(ls) would change without writing anything
+func (ss *Volumes) Plan(ls []*types.Volume) (*Plan[Volume], error) {
+	return ss.proxy.Plan(ss.local(ls))
+}
+
+func (ss *Volumes) PlanContext(ctx context.Context, ls []*types.Volume) (*Plan[Volume], error) {
+	return ss.proxy.PlanContext(ctx, ss.local(ls))
+}
+
+func (ss *Volumes) Apply(plan *Plan[Volume]) (*SyncResult, error) {
+	return ss.proxy.Apply(plan)
+}
+
+func (ss *Volumes) ApplyContext(ctx context.Context, plan *Plan[Volume]) (*SyncResult, error) {
+	return ss.proxy.ApplyContext(ctx, plan)
+}
+
+func (ss *Volumes) Sync(ls []*types.Volume) (*SyncResult, error) {
+	return ss.proxy.Sync(ss.local(ls))
+}
+
+func (ss *Volumes) SyncContext(ctx context.Context, ls []*types.Volume) (*SyncResult, error) {
+	return ss.proxy.SyncContext(ctx, ss.local(ls))
 }
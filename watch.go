@@ -0,0 +1,165 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/shipdock/libkv/store"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const (
+	WATCH_RETRY_MIN = 1 * time.Second
+	WATCH_RETRY_MAX = 30 * time.Second
+)
+
+type EventType int
+
+const (
+	EventAdded EventType = iota
+	EventUpdated
+	EventDeleted
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAdded:
+		return "added"
+	case EventUpdated:
+		return "updated"
+	case EventDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a change of one key. Old is nil for EventAdded, New is nil
+// for EventDeleted.
+type Event[T any] struct {
+	Type EventType
+	Key  string
+	Old  *T
+	New  *T
+}
+
+// Watch streams the changes below the proxy root. The stream starts with
+// an EventAdded for every existing value, then follows the backend's
+// WatchTree. When the backend watch ends (disconnect, reconnect) it is
+// re-established and the events bridge the gap, so callers see one
+// continuous stream until ctx is done.
+func (c *Proxy[T]) Watch(ctx context.Context) (<-chan Event[T], error) {
+	current, err := c.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	eventCh := make(chan Event[T])
+	go func() {
+		defer close(eventCh)
+		if !c.emit(ctx, eventCh, make(map[string]*T), current) {
+			return
+		}
+		retry := WATCH_RETRY_MIN
+		for {
+			stopCh := make(chan struct{})
+			watchCh, err := c.kvstore.WatchTree(c.rootPath, stopCh)
+			if err == nil {
+				retry = WATCH_RETRY_MIN
+				current, err = c.follow(ctx, eventCh, watchCh, current)
+			}
+			close(stopCh)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				c.logger.Warnf("watch %s: %v, retrying in %s", c.rootPath, err, retry)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			if retry *= 2; retry > WATCH_RETRY_MAX {
+				retry = WATCH_RETRY_MAX
+			}
+		}
+	}()
+	return eventCh, nil
+}
+
+// current lists the values a stream starts with, like List but without
+// quarantining.
+func (c *Proxy[T]) current(ctx context.Context) (map[string]*T, error) {
+	if kvs, ok := c.cachedList(ctx, true); ok {
+		rl, _ := c.decodeAll(kvs)
+		return rl, nil
+	}
+	rl, _, _, err := c.list(ctx, true, false)
+	return rl, err
+}
+
+// reportNew reports the failures which were not in reported, by store
+// key and index, and returns the failures of this tree. Watches never
+// quarantine.
+func (c *Proxy[T]) reportNew(failures []*DecodeFailure, reported map[string]uint64) map[string]uint64 {
+	next := make(map[string]uint64, len(failures))
+	for _, failure := range failures {
+		if index, ok := reported[failure.StoreKey]; !ok || index != failure.index {
+			c.parent.decodeFailed(failure)
+		}
+		next[failure.StoreKey] = failure.index
+	}
+	return next
+}
+
+// follow emits the differences of every tree the backend sends and
+// returns the last known state once the backend watch ends.
+func (c *Proxy[T]) follow(ctx context.Context, eventCh chan<- Event[T], watchCh <-chan []*store.KVPair, current map[string]*T) (map[string]*T, error) {
+	reported := make(map[string]uint64)
+	for {
+		select {
+		case <-ctx.Done():
+			return current, nil
+		case kvs, ok := <-watchCh:
+			if !ok {
+				return current, fmt.Errorf("backend watch closed")
+			}
+			next, failures := c.decodeAll(kvs)
+			reported = c.reportNew(failures, reported)
+			if !c.emit(ctx, eventCh, current, next) {
+				return current, nil
+			}
+			current = next
+		}
+	}
+}
+
+// emit sends the events turning prev into next in key order, it
+// returns false when ctx is done.
+func (c *Proxy[T]) emit(ctx context.Context, eventCh chan<- Event[T], prev, next map[string]*T) bool {
+	events := make([]Event[T], 0)
+	for k, nv := range next {
+		pv, ok := prev[k]
+		if !ok {
+			events = append(events, Event[T]{Type: EventAdded, Key: k, New: nv})
+		} else if !reflect.DeepEqual(pv, nv) {
+			events = append(events, Event[T]{Type: EventUpdated, Key: k, Old: pv, New: nv})
+		}
+	}
+	for k, pv := range prev {
+		if _, ok := next[k]; !ok {
+			events = append(events, Event[T]{Type: EventDeleted, Key: k, Old: pv})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Key < events[j].Key
+	})
+	for _, event := range events {
+		select {
+		case eventCh <- event:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
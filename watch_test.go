@@ -0,0 +1,49 @@
+package kvstore
+
+import (
+	"context"
+	types "github.com/docker/docker/api/types"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	k, err := NewKVStore("mem:///root", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if err := k.Volumes.Put(&types.Volume{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := k.Volumes.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() Event[Volume] {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout")
+		}
+		return Event[Volume]{}
+	}
+	if e := next(); e.Type != EventAdded || e.Key != "a" {
+		t.Fatal(e)
+	}
+	if err := k.Volumes.Put(&types.Volume{Name: "a", Driver: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Type != EventUpdated || e.Old.Driver != "" || e.New.Driver != "x" {
+		t.Fatal(e)
+	}
+	if err := k.Volumes.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Type != EventDeleted {
+		t.Fatal(e)
+	}
+}
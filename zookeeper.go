@@ -0,0 +1,118 @@
+package kvstore
+
+import (
+	"github.com/shipdock/libkv/store"
+	"path"
+)
+
+// zookeeperStore adapts the libkv zookeeper backend to the directory
+// semantics of consul/etcd. ZooKeeper keeps every path segment as a znode,
+// so intermediate "directories" show up as nodes with empty data and a
+// node with children can not be deleted directly.
+type zookeeperStore struct {
+	store.Store
+}
+
+func newZookeeperStore(s store.Store) store.Store {
+	return &zookeeperStore{Store: s}
+}
+
+// children returns the direct children of directory with keys
+// joined to directory (libkv returns bare znode names).
+func (z *zookeeperStore) children(directory string) ([]*store.KVPair, error) {
+	kvs, err := z.Store.List(directory, false)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*store.KVPair, 0, len(kvs))
+	for _, kv := range kvs {
+		results = append(results, &store.KVPair{
+			Key:       path.Join(directory, path.Base(kv.Key)),
+			Value:     kv.Value,
+			LastIndex: kv.LastIndex,
+		})
+	}
+	return results, nil
+}
+
+// Get treats data-less znodes as directories, which consul and etcd
+// do not return as values either.
+func (z *zookeeperStore) Get(key string) (*store.KVPair, error) {
+	kv, err := z.Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(kv.Value) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return kv, nil
+}
+
+func (z *zookeeperStore) List(directory string, recursive bool) ([]*store.KVPair, error) {
+	kvs, err := z.children(directory)
+	if err != nil {
+		return nil, err
+	}
+	if !recursive {
+		return kvs, nil
+	}
+	results := make([]*store.KVPair, 0, len(kvs))
+	for _, kv := range kvs {
+		// only znodes holding data are values, intermediate
+		// znodes are walked like directories
+		if len(kv.Value) > 0 {
+			results = append(results, kv)
+		}
+		sub, err := z.List(kv.Key, true)
+		if err != nil {
+			if err == store.ErrKeyNotFound {
+				continue
+			}
+			return nil, err
+		}
+		results = append(results, sub...)
+	}
+	return results, nil
+}
+
+func (z *zookeeperStore) DeleteTree(directory string) error {
+	kvs, err := z.children(directory)
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if err := z.DeleteTree(kv.Key); err != nil && err != store.ErrKeyNotFound {
+			return err
+		}
+	}
+	return z.Store.Delete(directory)
+}
+
+// WatchTree sends the tree of directory as List returns it. libkv only
+// notices changes to the direct children of directory and sends them
+// with bare znode names, its events are used as triggers only.
+func (z *zookeeperStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	events, err := z.Store.WatchTree(directory, stopCh)
+	if err != nil {
+		return nil, err
+	}
+	watchCh := make(chan []*store.KVPair)
+	go func() {
+		defer close(watchCh)
+		for range events {
+			kvs, err := z.List(directory, true)
+			if err != nil {
+				if err != store.ErrKeyNotFound {
+					continue
+				}
+				kvs = []*store.KVPair{}
+			}
+			select {
+			case watchCh <- kvs:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return watchCh, nil
+}